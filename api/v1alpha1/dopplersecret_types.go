@@ -57,6 +57,18 @@ type ManagedSecretReference struct {
 	// Annotations to add or update on the managed secret
 	// +optional
 	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// What happens to the managed secret when the DopplerSecret is deleted. 'Retain' (the default) leaves the secret as is,
+	// 'Delete' deletes it and 'Orphan' leaves it in place with the secrets.doppler.com/orphaned label.
+	// +kubebuilder:validation:Enum=Retain;Delete;Orphan
+	// +kubebuilder:default=Retain
+	// +optional
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+
+	// Whether to take over an existing secret which isn't managed by this DopplerSecret. By default, the operator refuses to
+	// overwrite a secret without a secrets.doppler.com/managed-by annotation referring to this DopplerSecret.
+	// +optional
+	Adopt bool `json:"adopt,omitempty"`
 }
 
 type SecretProcessor struct {
@@ -74,6 +86,69 @@ type SecretProcessors map[string]*SecretProcessor
 
 var DefaultProcessor = SecretProcessor{Type: "plain"}
 
+// A workload to reload when the managed secret changes
+type ReloadTarget struct {
+	// The API version of the workload, e.g. apps/v1. Matches any version of the kind if empty.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// The kind of the workload, e.g. Deployment
+	Kind string `json:"kind"`
+
+	// The name of the workload, in the namespace of the managed secret
+	Name string `json:"name"`
+}
+
+// Configuration for reloading workloads which use the managed secret
+type ReloadSpec struct {
+	// Reloads workloads matching this label selector which use the managed secret, in addition to workloads with the secrets.doppler.com/reload annotation
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// Workloads to always reload when the managed secret changes, even if they don't reference it in their pod template
+	// +optional
+	Targets []ReloadTarget `json:"targets,omitempty"`
+
+	// The maximum number of workloads to restart at once. Defaults to 0, which restarts all workloads at once.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	BatchSize int32 `json:"batchSize,omitempty"`
+
+	// The number of seconds to wait after restarting a batch of workloads before restarting the next batch
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	BatchPauseSeconds int64 `json:"batchPauseSeconds,omitempty"`
+
+	// Whether to wait for restarted workloads to become available before restarting the next batch
+	// +optional
+	WaitForAvailable bool `json:"waitForAvailable,omitempty"`
+
+	// The minimum number of seconds between restarts of the same workload. Secret changes made within this interval are
+	// coalesced into a single restart once it has elapsed.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinRestartIntervalSeconds int64 `json:"minRestartIntervalSeconds,omitempty"`
+
+	// The number of seconds to wait after the managed secret changes before restarting workloads. Each change within
+	// the window restarts the wait, so a burst of changes results in a single restart.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	DebounceSeconds int64 `json:"debounceSeconds,omitempty"`
+
+	// Whether to restore the previous secrets to the managed secret when a restarted workload fails to roll out.
+	// Syncing is then held until the Doppler secrets change again.
+	// +optional
+	RollbackOnFailedRollout bool `json:"rollbackOnFailedRollout,omitempty"`
+
+	// How workloads are restarted. 'annotation' (the default) sets a secret version annotation on the pod template,
+	// 'restartedAt' sets the standard kubectl.kubernetes.io/restartedAt pod template annotation and 'evict' evicts
+	// the workload's pods through the Eviction API so PodDisruptionBudgets are respected.
+	// Can be overridden per workload with the secrets.doppler.com/restart-strategy annotation.
+	// +kubebuilder:validation:Enum=annotation;restartedAt;evict
+	// +optional
+	Strategy string `json:"strategy,omitempty"`
+}
+
 // DopplerSecretSpec defines the desired state of DopplerSecret
 // +kubebuilder:validation:XValidation:rule="(has(self.tokenSecret) && !has(self.identity)) || (!has(self.tokenSecret) && has(self.identity))",message="Must specify either tokenSecret or identity, but not both"
 type DopplerSecretSpec struct {
@@ -129,15 +204,134 @@ type DopplerSecretSpec struct {
 	// The number of seconds to wait between resyncs
 	// +kubebuilder:default=60
 	ResyncSeconds int64 `json:"resyncSeconds,omitempty"`
+
+	// Configuration for reloading workloads which use the managed secret
+	// +optional
+	Reload ReloadSpec `json:"reload,omitempty"`
+}
+
+// WorkloadStatus describes a workload which is reloaded when the managed secret changes
+type WorkloadStatus struct {
+	// The API version of the workload
+	APIVersion string `json:"apiVersion"`
+
+	// The kind of the workload
+	Kind string `json:"kind"`
+
+	// The name of the workload
+	Name string `json:"name"`
+
+	// Why the workload is reloaded: its reload annotation, the reload selector or the reload targets
+	// +kubebuilder:validation:Enum=Annotation;Selector;Target
+	// +optional
+	Source string `json:"source,omitempty"`
+
+	// The managed secret version the workload was last restarted for
+	// +optional
+	SecretVersion string `json:"secretVersion,omitempty"`
+
+	// The state of the workload's most recent rollout
+	// +kubebuilder:validation:Enum=Progressing;Complete;Failed
+	// +optional
+	RolloutState string `json:"rolloutState,omitempty"`
+
+	// When the workload was last restarted by the operator
+	// +optional
+	LastRestartTime *metav1.Time `json:"lastRestartTime,omitempty"`
+
+	// When the workload is scheduled to be restarted for a pending secret change
+	// +optional
+	NextRestartTime *metav1.Time `json:"nextRestartTime,omitempty"`
+}
+
+// RollbackStatus describes a rollback of the managed secret after a failed workload rollout
+type RollbackStatus struct {
+	// The secrets version which caused the workload rollouts to fail. Syncing is held until the Doppler secrets change from this version.
+	FailedVersion string `json:"failedVersion"`
+
+	// The secrets version restored to the managed secret
+	RestoredVersion string `json:"restoredVersion"`
+
+	// The workloads whose rollouts failed
+	// +optional
+	FailedWorkloads []string `json:"failedWorkloads,omitempty"`
+
+	// When the managed secret was rolled back
+	Time metav1.Time `json:"time"`
+}
+
+// ManagedSecretStatus identifies the managed secret most recently synced by a DopplerSecret
+type ManagedSecretStatus struct {
+	// The name of the managed secret
+	Name string `json:"name"`
+
+	// The namespace of the managed secret
+	Namespace string `json:"namespace"`
 }
 
 // DopplerSecretStatus defines the observed state of DopplerSecret
 type DopplerSecretStatus struct {
 	Conditions []metav1.Condition `json:"conditions"`
+
+	// The workloads which are reloaded when the managed secret changes
+	// +optional
+	Workloads []WorkloadStatus `json:"workloads,omitempty"`
+
+	// The most recent rollback of the managed secret, cleared once the Doppler secrets change
+	// +optional
+	Rollback *RollbackStatus `json:"rollback,omitempty"`
+
+	// The managed secret most recently synced, used to detect when the managed secret reference changes
+	// +optional
+	ManagedSecret *ManagedSecretStatus `json:"managedSecret,omitempty"`
+
+	// The generation of the DopplerSecret most recently reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// When the managed secret was last successfully synced with Doppler, whether or not the secrets had changed
+	// +optional
+	LastSuccessfulSyncTime *metav1.Time `json:"lastSuccessfulSyncTime,omitempty"`
+
+	// When the operator last attempted to sync the managed secret
+	// +optional
+	LastAttemptTime *metav1.Time `json:"lastAttemptTime,omitempty"`
+
+	// The Doppler secrets version (ETag) currently in the managed secret
+	// +optional
+	ETag string `json:"etag,omitempty"`
+
+	// The Doppler project synced, as resolved from the token if not set in the spec
+	// +optional
+	Project string `json:"project,omitempty"`
+
+	// The Doppler config synced, as resolved from the token if not set in the spec
+	// +optional
+	Config string `json:"config,omitempty"`
+
+	// The number of keys synced to the managed secret
+	// +optional
+	KeyCount int `json:"keyCount,omitempty"`
+
+	// The number of consecutive failed syncs since the last successful sync or spec change
+	// +optional
+	FailureCount int `json:"failureCount,omitempty"`
+
+	// When the operator will retry a failed sync, after backing off exponentially
+	// +optional
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="secrets.doppler.com/SecretSyncReady")].status`
+//+kubebuilder:printcolumn:name="Project",type=string,JSONPath=`.status.project`
+//+kubebuilder:printcolumn:name="Config",type=string,JSONPath=`.status.config`
+//+kubebuilder:printcolumn:name="Keys",type=integer,JSONPath=`.status.keyCount`
+//+kubebuilder:printcolumn:name="Last Sync",type=date,JSONPath=`.status.lastSuccessfulSyncTime`
+//+kubebuilder:printcolumn:name="Failures",type=integer,JSONPath=`.status.failureCount`,priority=1
+//+kubebuilder:printcolumn:name="ETag",type=string,JSONPath=`.status.etag`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // DopplerSecret is the Schema for the dopplersecrets API
 type DopplerSecret struct {
@@ -110,6 +110,7 @@ func (in *DopplerSecretSpec) DeepCopyInto(out *DopplerSecretSpec) {
 			(*out)[key] = outVal
 		}
 	}
+	in.Reload.DeepCopyInto(&out.Reload)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DopplerSecretSpec.
@@ -132,6 +133,35 @@ func (in *DopplerSecretStatus) DeepCopyInto(out *DopplerSecretStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Workloads != nil {
+		in, out := &in.Workloads, &out.Workloads
+		*out = make([]WorkloadStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Rollback != nil {
+		in, out := &in.Rollback, &out.Rollback
+		*out = new(RollbackStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ManagedSecret != nil {
+		in, out := &in.ManagedSecret, &out.ManagedSecret
+		*out = new(ManagedSecretStatus)
+		**out = **in
+	}
+	if in.LastSuccessfulSyncTime != nil {
+		in, out := &in.LastSuccessfulSyncTime, &out.LastSuccessfulSyncTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastAttemptTime != nil {
+		in, out := &in.LastAttemptTime, &out.LastAttemptTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextRetryTime != nil {
+		in, out := &in.NextRetryTime, &out.NextRetryTime
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DopplerSecretStatus.
@@ -173,6 +203,82 @@ func (in *ManagedSecretReference) DeepCopy() *ManagedSecretReference {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ManagedSecretStatus) DeepCopyInto(out *ManagedSecretStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagedSecretStatus.
+func (in *ManagedSecretStatus) DeepCopy() *ManagedSecretStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ManagedSecretStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReloadSpec) DeepCopyInto(out *ReloadSpec) {
+	*out = *in
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Targets != nil {
+		in, out := &in.Targets, &out.Targets
+		*out = make([]ReloadTarget, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReloadSpec.
+func (in *ReloadSpec) DeepCopy() *ReloadSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ReloadSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReloadTarget) DeepCopyInto(out *ReloadTarget) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReloadTarget.
+func (in *ReloadTarget) DeepCopy() *ReloadTarget {
+	if in == nil {
+		return nil
+	}
+	out := new(ReloadTarget)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RollbackStatus) DeepCopyInto(out *RollbackStatus) {
+	*out = *in
+	if in.FailedWorkloads != nil {
+		in, out := &in.FailedWorkloads, &out.FailedWorkloads
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RollbackStatus.
+func (in *RollbackStatus) DeepCopy() *RollbackStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RollbackStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SecretProcessor) DeepCopyInto(out *SecretProcessor) {
 	*out = *in
@@ -232,3 +338,26 @@ func (in *TokenSecretReference) DeepCopy() *TokenSecretReference {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkloadStatus) DeepCopyInto(out *WorkloadStatus) {
+	*out = *in
+	if in.LastRestartTime != nil {
+		in, out := &in.LastRestartTime, &out.LastRestartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextRestartTime != nil {
+		in, out := &in.NextRestartTime, &out.NextRestartTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkloadStatus.
+func (in *WorkloadStatus) DeepCopy() *WorkloadStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkloadStatus)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -19,13 +19,20 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
 )
@@ -35,6 +42,24 @@ type DopplerSecretReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// The kinds of workloads which can be reloaded, defaults to DefaultWorkloadKinds
+	WorkloadKinds []WorkloadKind
+
+	// Limits and paces workload restarts, defaults to an unlimited orchestrator
+	Rollouts *RolloutOrchestrator
+
+	// Records events on DopplerSecrets, events aren't recorded if nil
+	Recorder record.EventRecorder
+
+	// How long to wait before retrying failed syncs, defaults to DefaultFailureBackoff
+	Backoff *FailureBackoff
+
+	// Spreads out resyncs, defaults to a schedule without jitter or startup stagger
+	Schedule *ResyncSchedule
+
+	// The resource version of each managed secret most recently written by the operator, so the operator's own writes can be ignored
+	appliedSecretVersions sync.Map
 }
 
 const (
@@ -45,9 +70,13 @@ const (
 //+kubebuilder:rbac:groups=secrets.doppler.com,resources=dopplersecrets/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=secrets.doppler.com,resources=dopplersecrets/finalizers,verbs=update
 
-//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=serviceaccounts/token,verbs=create
-//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=list;watch;get;update
+//+kubebuilder:rbac:groups="",resources=pods,verbs=list
+//+kubebuilder:rbac:groups="",resources=pods/eviction,verbs=create
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets;replicasets,verbs=list;watch;get;update
+//+kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=list;watch;get;update
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -68,6 +97,8 @@ func (r *DopplerSecretReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	err := r.Client.Get(ctx, req.NamespacedName, &dopplerSecret)
 	if err != nil {
 		if errors.IsNotFound(err) {
+			// DopplerSecrets without a finalizer are deleted without a final reconcile, so release their restart slots here
+			r.Rollouts.forget(req.NamespacedName)
 			log.Info("[-] dopplersecret not found, nothing to do")
 			return ctrl.Result{}, nil
 		}
@@ -100,6 +131,12 @@ func (r *DopplerSecretReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 			dopplerSecret.Namespace, dopplerSecret.Name, ownNamespace,
 			authNamespace, authName, managedSecretNamespace, dopplerSecret.Spec.ManagedSecretRef.Name)
 		log.Error(err, "")
+		if dopplerSecret.GetDeletionTimestamp() != nil && controllerutil.RemoveFinalizer(&dopplerSecret, dopplerSecretFinalizer) {
+			// The references were never allowed so there's nothing to clean up
+			if err := r.Client.Update(ctx, &dopplerSecret); err != nil {
+				log.Error(err, "Unable to remove finalizer")
+			}
+		}
 		return ctrl.Result{}, nil
 	}
 
@@ -109,31 +146,85 @@ func (r *DopplerSecretReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	if dopplerSecret.Spec.ResyncSeconds != 0 {
 		requeueAfter = time.Second * time.Duration(dopplerSecret.Spec.ResyncSeconds)
 	}
+	// Offset each DopplerSecret's resyncs so they don't all call the Doppler API at once
+	requeueAfter = r.Schedule.ResyncInterval(dopplerSecret, requeueAfter)
 	log.Info("Requeue duration set", "requeueAfter", requeueAfter)
 
 	if dopplerSecret.GetDeletionTimestamp() != nil {
-		log.Info("dopplersecret has been deleted, nothing to do")
+		if err := r.ReconcileDeletion(ctx, &dopplerSecret); err != nil {
+			log.Error(err, "Unable to clean up managed secret")
+			return ctrl.Result{
+				RequeueAfter: requeueAfter,
+			}, nil
+		}
 		return ctrl.Result{}, nil
 	}
 
-	err = r.UpdateSecret(ctx, dopplerSecret)
-	r.SetSecretsSyncReadyCondition(ctx, &dopplerSecret, err)
-	if err != nil {
-		log.Error(err, "Unable to update dopplersecret")
+	// Changes to watched secrets and workloads also trigger a reconcile, so hold off until a failed sync is due to be retried
+	if retryAfter := getFailureRetryDelay(dopplerSecret, time.Now()); retryAfter > 0 {
+		log.Info("Waiting to retry failed sync", "failureCount", dopplerSecret.Status.FailureCount, "retryAfter", retryAfter)
+		return ctrl.Result{
+			RequeueAfter: retryAfter,
+		}, nil
+	}
+
+	if startupDelay := r.Schedule.StartupDelay(dopplerSecret); startupDelay > 0 {
+		log.Info("Delaying initial reconcile to spread out syncs after startup", "startupDelay", startupDelay)
+		return ctrl.Result{
+			RequeueAfter: startupDelay,
+		}, nil
+	}
+
+	if err := r.ReconcileFinalizer(ctx, &dopplerSecret); err != nil {
+		log.Error(err, "Unable to reconcile finalizer")
 		return ctrl.Result{
 			RequeueAfter: requeueAfter,
 		}, nil
 	}
 
-	numDeployments, err := r.ReconcileDeploymentsUsingSecret(ctx, dopplerSecret)
-	r.SetDeploymentReloadReadyCondition(ctx, &dopplerSecret, numDeployments, err)
+	// Only one DopplerSecret may sync a managed secret, otherwise they would overwrite each other on every resync
+	var syncResult SecretSyncResult
+	err = r.CheckManagedSecretConflict(ctx, dopplerSecret)
+	if err == nil {
+		syncResult, err = r.UpdateSecret(ctx, dopplerSecret)
+	}
+	r.SetSecretsSyncReadyCondition(ctx, &dopplerSecret, syncResult, err)
 	if err != nil {
-		log.Error(err, "Failed to update deployments")
+		// Back off from failing DopplerSecrets rather than retrying them at the resync interval indefinitely
+		retryAfter := time.Until(dopplerSecret.Status.NextRetryTime.Time)
+		log.Error(err, "Unable to update dopplersecret", "failureCount", dopplerSecret.Status.FailureCount, "retryAfter", retryAfter)
+		return ctrl.Result{
+			RequeueAfter: retryAfter,
+		}, nil
+	}
+
+	if err := r.ReconcileManagedSecretTarget(ctx, &dopplerSecret); err != nil {
+		log.Error(err, "Unable to clean up previous managed secret")
+	}
+
+	reloadResult, err := r.ReconcileWorkloadsUsingSecret(ctx, dopplerSecret)
+	r.SetDeploymentReloadReadyCondition(ctx, &dopplerSecret, reloadResult, err)
+	if err != nil {
+		log.Error(err, "Failed to update workloads")
 		return ctrl.Result{
 			RequeueAfter: requeueAfter,
 		}, nil
 	}
 
+	rolledBack, err := r.ReconcileRollback(ctx, &dopplerSecret, reloadResult)
+	if err != nil {
+		log.Error(err, "Failed to roll back managed secret")
+	} else if rolledBack {
+		// Restart the workloads using the restored secret right away
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	// Check back sooner if workload restarts are still in progress
+	if reloadResult.RequeueAfter > 0 && reloadResult.RequeueAfter < requeueAfter {
+		requeueAfter = reloadResult.RequeueAfter
+		log.Info("Requeue duration shortened for pending workload restarts", "requeueAfter", requeueAfter)
+	}
+
 	log.Info("Finished reconciliation")
 	return ctrl.Result{
 		RequeueAfter: requeueAfter,
@@ -142,7 +233,26 @@ func (r *DopplerSecretReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *DopplerSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&secretsv1alpha1.DopplerSecret{}).
-		Complete(r)
+	if r.Rollouts == nil {
+		r.Rollouts = NewRolloutOrchestrator(0)
+	}
+	if r.Schedule == nil {
+		r.Schedule = NewResyncSchedule(0, 0)
+	}
+	if err := r.setupIndexes(context.Background(), mgr); err != nil {
+		return err
+	}
+	controllerBuilder := ctrl.NewControllerManagedBy(mgr).
+		// Status updates record every sync attempt, so only spec changes and deletions trigger a reconcile. Otherwise each status update would trigger another sync.
+		For(&secretsv1alpha1.DopplerSecret{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		// Repair managed secrets as soon as they're modified or deleted outside of the operator and pick up rotated tokens
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.mapSecretToDopplerSecrets), builder.WithPredicates(r.ignoreAppliedSecretVersions())).
+		// Let the next DopplerSecret targeting a managed secret take over when the one syncing it is deleted or retargeted
+		Watches(&secretsv1alpha1.DopplerSecret{}, handler.EnqueueRequestsFromMapFunc(r.mapDopplerSecretToConflicts), builder.WithPredicates(predicate.GenerationChangedPredicate{}))
+	// Reconcile DopplerSecrets as soon as a workload using their managed secret is created, deleted or changed in a way that affects reloading
+	for i := range r.getWorkloadKinds() {
+		kind := &r.getWorkloadKinds()[i]
+		controllerBuilder = controllerBuilder.Watches(kind.NewObject(), handler.EnqueueRequestsFromMapFunc(r.mapWorkloadToDopplerSecrets(kind)), builder.WithPredicates(workloadChangedPredicate()))
+	}
+	return controllerBuilder.Complete(r)
 }
@@ -0,0 +1,149 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/csaupgrade"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// The field manager used to server-side apply managed secrets
+const managedSecretFieldManager = "doppler-kubernetes-operator"
+
+// Earlier versions of the operator wrote managed secrets with regular updates, which are recorded under the name of the operator binary
+var legacyManagedSecretFieldManagers = sets.New("manager")
+
+// ManagedSecretFields are the labels, annotations and data keys of a managed secret owned by the operator's field manager
+type ManagedSecretFields struct {
+	Labels      sets.Set[string]
+	Annotations sets.Set[string]
+	Data        sets.Set[string]
+}
+
+// GetManagedSecretFields returns the fields of a secret last applied by the operator. Returns false if the operator hasn't applied the secret.
+func GetManagedSecretFields(secret corev1.Secret) (ManagedSecretFields, bool) {
+	fields := ManagedSecretFields{Labels: sets.New[string](), Annotations: sets.New[string](), Data: sets.New[string]()}
+	found := false
+	for _, entry := range secret.ManagedFields {
+		if entry.Manager != managedSecretFieldManager || entry.Operation != metav1.ManagedFieldsOperationApply || entry.FieldsV1 == nil {
+			continue
+		}
+		// Field sets look like {"f:data":{"f:KEY":{}},"f:metadata":{"f:labels":{"f:KEY":{}}}}
+		fieldSet := struct {
+			Data     map[string]json.RawMessage `json:"f:data"`
+			Metadata struct {
+				Labels      map[string]json.RawMessage `json:"f:labels"`
+				Annotations map[string]json.RawMessage `json:"f:annotations"`
+			} `json:"f:metadata"`
+		}{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fieldSet); err != nil {
+			continue
+		}
+		found = true
+		addFieldSetKeys(fields.Labels, fieldSet.Metadata.Labels)
+		addFieldSetKeys(fields.Annotations, fieldSet.Metadata.Annotations)
+		addFieldSetKeys(fields.Data, fieldSet.Data)
+	}
+	return fields, found
+}
+
+func addFieldSetKeys(keys sets.Set[string], fieldSet map[string]json.RawMessage) {
+	for field := range fieldSet {
+		if key, ok := strings.CutPrefix(field, "f:"); ok {
+			keys.Insert(key)
+		}
+	}
+}
+
+// Returns true if any desired key is missing or different, or if a key the operator previously applied is no longer desired
+func hasAppliedKeysChanged(existing map[string]string, desired map[string]string, applied sets.Set[string]) bool {
+	for k, v := range desired {
+		if existingValue, ok := existing[k]; !ok || existingValue != v {
+			return true
+		}
+	}
+	for k := range applied {
+		if _, ok := desired[k]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves ownership of fields written by earlier versions of the operator to the operator's field manager.
+// Without this, applying the secret couldn't remove labels, annotations or keys which the operator no longer sets.
+func (r *DopplerSecretReconciler) upgradeManagedSecretFields(ctx context.Context, secret *corev1.Secret) error {
+	patch, err := csaupgrade.UpgradeManagedFieldsPatch(secret, legacyManagedSecretFieldManagers, managedSecretFieldManager)
+	if err != nil {
+		return fmt.Errorf("Failed to compute managed fields upgrade: %w", err)
+	}
+	if patch == nil {
+		return nil
+	}
+	if err := r.Client.Patch(ctx, secret, client.RawPatch(types.JSONPatchType, patch)); err != nil {
+		return fmt.Errorf("Failed to upgrade managed fields: %w", err)
+	}
+	r.appliedSecretVersions.Store(client.ObjectKeyFromObject(secret), secret.ResourceVersion)
+	r.Log.Info("[/] Upgraded managed secret to server-side apply", "secret", client.ObjectKeyFromObject(secret).String())
+	return nil
+}
+
+// Writes the managed secret with server-side apply. The operator only owns the fields set on the secret, so labels, annotations
+// and keys set by other field managers are left in place. Any of the operator's own fields modified by others are taken back.
+// If the secret has a resource version, the apply fails with a conflict if the secret has changed since.
+func (r *DopplerSecretReconciler) applyManagedSecret(ctx context.Context, secret *corev1.Secret) error {
+	secret.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+	secret.ManagedFields = nil
+	if err := r.Client.Patch(ctx, secret, client.Apply, client.FieldOwner(managedSecretFieldManager), client.ForceOwnership); err != nil {
+		return err
+	}
+	r.appliedSecretVersions.Store(client.ObjectKeyFromObject(secret), secret.ResourceVersion)
+	return nil
+}
+
+// Ignores events for secrets written by the operator itself, which would otherwise trigger another sync after every write.
+// Any later change, e.g. an edit to a managed secret or a rotated token, has a different resource version and is still handled.
+func (r *DopplerSecretReconciler) ignoreAppliedSecretVersions() predicate.Funcs {
+	isApplied := func(secret client.Object) bool {
+		version, ok := r.appliedSecretVersions.Load(client.ObjectKeyFromObject(secret))
+		return ok && version == secret.GetResourceVersion()
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return !isApplied(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return !isApplied(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			// Deleted secrets are always handled, and no longer need to be tracked
+			r.appliedSecretVersions.Delete(client.ObjectKeyFromObject(e.Object))
+			return true
+		},
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestGetManagedSecretFields(t *testing.T) {
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{ManagedFields: []metav1.ManagedFieldsEntry{
+		{
+			Manager:   managedSecretFieldManager,
+			Operation: metav1.ManagedFieldsOperationApply,
+			FieldsV1:  &metav1.FieldsV1{Raw: []byte(`{"f:data":{"f:API_KEY":{}},"f:metadata":{"f:annotations":{"f:secrets.doppler.com/version":{}},"f:labels":{"f:secrets.doppler.com/subtype":{}}},"f:type":{}}`)},
+		},
+		{
+			Manager:   "reflector",
+			Operation: metav1.ManagedFieldsOperationUpdate,
+			FieldsV1:  &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:reflector.v1.k8s.emberstack.com/reflection-allowed":{}}}}`)},
+		},
+	}}}
+
+	fields, applied := GetManagedSecretFields(secret)
+	if !applied {
+		t.Fatal("expected secret to be applied by the operator")
+	}
+	if !fields.Labels.Equal(sets.New(kubeSecretSubtypeLabel)) {
+		t.Errorf("unexpected labels %v", sets.List(fields.Labels))
+	}
+	if !fields.Annotations.Equal(sets.New(kubeSecretVersionAnnotation)) {
+		t.Errorf("unexpected annotations %v", sets.List(fields.Annotations))
+	}
+	if !fields.Data.Equal(sets.New("API_KEY")) {
+		t.Errorf("unexpected data keys %v", sets.List(fields.Data))
+	}
+
+	if _, applied := GetManagedSecretFields(corev1.Secret{}); applied {
+		t.Error("expected secret without managed fields not to be applied by the operator")
+	}
+}
+
+func TestHasAppliedKeysChanged(t *testing.T) {
+	existing := map[string]string{"team": "payments", "backup": "velero"}
+	tests := []struct {
+		name     string
+		desired  map[string]string
+		applied  sets.Set[string]
+		expected bool
+	}{
+		{name: "unchanged", desired: map[string]string{"team": "payments"}, applied: sets.New("team"), expected: false},
+		{name: "value changed", desired: map[string]string{"team": "billing"}, applied: sets.New("team"), expected: true},
+		{name: "key added", desired: map[string]string{"team": "payments", "env": "prod"}, applied: sets.New("team"), expected: true},
+		{name: "applied key removed", desired: map[string]string{}, applied: sets.New("team"), expected: true},
+		{name: "key set by others", desired: nil, applied: sets.New[string](), expected: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if changed := hasAppliedKeysChanged(existing, test.desired, test.applied); changed != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, changed)
+			}
+		})
+	}
+}
+
+func TestIgnoreAppliedSecretVersions(t *testing.T) {
+	r := &DopplerSecretReconciler{}
+	predicate := r.ignoreAppliedSecretVersions()
+	newSecret := func(resourceVersion string) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "managed", Namespace: "default", ResourceVersion: resourceVersion}}
+	}
+	r.appliedSecretVersions.Store(client.ObjectKeyFromObject(newSecret("")), "2")
+
+	if predicate.Create(event.CreateEvent{Object: newSecret("2")}) {
+		t.Error("expected the secret created by the operator to be ignored")
+	}
+	if predicate.Update(event.UpdateEvent{ObjectOld: newSecret("1"), ObjectNew: newSecret("2")}) {
+		t.Error("expected the update applied by the operator to be ignored")
+	}
+	if !predicate.Update(event.UpdateEvent{ObjectOld: newSecret("2"), ObjectNew: newSecret("3")}) {
+		t.Error("expected a later update to be handled")
+	}
+	if !predicate.Update(event.UpdateEvent{ObjectOld: newSecret("1"), ObjectNew: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default", ResourceVersion: "2"}}}) {
+		t.Error("expected updates to other secrets to be handled")
+	}
+	if !predicate.Delete(event.DeleteEvent{Object: newSecret("2")}) {
+		t.Error("expected the deletion to be handled")
+	}
+	if !predicate.Update(event.UpdateEvent{ObjectOld: newSecret("1"), ObjectNew: newSecret("2")}) {
+		t.Error("expected deleted secrets to no longer be tracked")
+	}
+}
+
+// Returns a fake client builder which emulates server-side apply of secrets, which the fake client doesn't support.
+// The applied labels, annotations and keys replace those previously applied by the operator and are recorded in the secret's managed fields.
+func newTestApplyClientBuilder(t *testing.T) *fake.ClientBuilder {
+	t.Helper()
+	return fake.NewClientBuilder().
+		WithScheme(newTestScheme(t)).
+		WithInterceptorFuncs(interceptor.Funcs{Patch: applySecretPatch})
+}
+
+func applySecretPatch(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Patch(ctx, obj, patch, opts...)
+	}
+	applied, ok := obj.(*corev1.Secret)
+	if !ok {
+		return fmt.Errorf("apply patches are only emulated for secrets, got %T", obj)
+	}
+	patchOptions := &client.PatchOptions{}
+	patchOptions.ApplyOptions(opts)
+	if patchOptions.FieldManager != managedSecretFieldManager {
+		return fmt.Errorf("apply patches are only emulated for the %s field manager, got %q", managedSecretFieldManager, patchOptions.FieldManager)
+	}
+
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, client.ObjectKeyFromObject(applied), secret)
+	exists := err == nil
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: applied.Namespace, Name: applied.Name}, Type: applied.Type}
+	} else if err != nil {
+		return err
+	}
+	if applied.ResourceVersion != "" && applied.ResourceVersion != secret.ResourceVersion {
+		return apierrors.NewConflict(corev1.Resource("secrets"), applied.Name, fmt.Errorf("the object has been modified"))
+	}
+
+	// Fields previously applied by the operator which are no longer applied are removed
+	previous, _ := GetManagedSecretFields(*secret)
+	secret.Labels = mergeAppliedFields(secret.Labels, previous.Labels, applied.Labels)
+	secret.Annotations = mergeAppliedFields(secret.Annotations, previous.Annotations, applied.Annotations)
+	for k := range previous.Data {
+		delete(secret.Data, k)
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for k, v := range applied.Data {
+		secret.Data[k] = v
+	}
+
+	fieldSet := map[string]interface{}{
+		"f:data":     getFieldSetKeys(maps.Keys(applied.Data)),
+		"f:metadata": map[string]interface{}{"f:labels": getFieldSetKeys(maps.Keys(applied.Labels)), "f:annotations": getFieldSetKeys(maps.Keys(applied.Annotations))},
+	}
+	fieldSetJson, err := json.Marshal(fieldSet)
+	if err != nil {
+		return err
+	}
+	managedFields := slices.DeleteFunc(secret.ManagedFields, func(entry metav1.ManagedFieldsEntry) bool {
+		return entry.Manager == managedSecretFieldManager && entry.Operation == metav1.ManagedFieldsOperationApply
+	})
+	secret.ManagedFields = append(managedFields, metav1.ManagedFieldsEntry{
+		Manager:    managedSecretFieldManager,
+		Operation:  metav1.ManagedFieldsOperationApply,
+		APIVersion: "v1",
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: fieldSetJson},
+	})
+
+	if exists {
+		err = c.Update(ctx, secret)
+	} else {
+		err = c.Create(ctx, secret)
+	}
+	if err != nil {
+		return err
+	}
+	secret.DeepCopyInto(applied)
+	return nil
+}
+
+func mergeAppliedFields(existing map[string]string, previouslyApplied sets.Set[string], applied map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range existing {
+		if !previouslyApplied.Has(k) {
+			merged[k] = v
+		}
+	}
+	for k, v := range applied {
+		merged[k] = v
+	}
+	return merged
+}
+
+func getFieldSetKeys(keys iter.Seq[string]) map[string]interface{} {
+	fieldSet := map[string]interface{}{}
+	for k := range keys {
+		fieldSet["f:"+k] = map[string]interface{}{}
+	}
+	return fieldSet
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+	"github.com/DopplerHQ/kubernetes-operator/pkg/api"
+)
+
+// The fraction by which backoff delays are randomly shortened, so DopplerSecrets which failed together don't retry together
+const failureBackoffJitter = 0.2
+
+// FailureBackoff computes how long to wait before retrying a DopplerSecret whose sync failed.
+// The delay doubles with each consecutive failure, up to a maximum.
+type FailureBackoff struct {
+	// The delay after the first failure
+	Base time.Duration
+
+	// The maximum delay
+	Max time.Duration
+
+	// The maximum delay for failures which won't resolve without intervention, e.g. a revoked token
+	MaxNonRetryable time.Duration
+}
+
+// DefaultFailureBackoff is used if the reconciler doesn't set a backoff
+var DefaultFailureBackoff = FailureBackoff{
+	Base:            5 * time.Second,
+	Max:             5 * time.Minute,
+	MaxNonRetryable: time.Hour,
+}
+
+func (r *DopplerSecretReconciler) getFailureBackoff() FailureBackoff {
+	if r.Backoff == nil {
+		return DefaultFailureBackoff
+	}
+	return *r.Backoff
+}
+
+// Returns true if retrying a failed sync may succeed without any changes, i.e. the failure isn't an authentication failure
+func isRetryableSyncError(err error) bool {
+	var apiErr *api.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Class != api.ErrorClassUnauthorized && apiErr.Class != api.ErrorClassForbidden
+	}
+	return true
+}
+
+// Delay returns how long to wait before retrying after the given number of consecutive failures
+func (b FailureBackoff) Delay(failureCount int, err error) time.Duration {
+	maxDelay := b.Max
+	if !isRetryableSyncError(err) {
+		maxDelay = max(b.Max, b.MaxNonRetryable)
+	}
+	delay := b.Base
+	for i := 1; i < failureCount && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	return delay - time.Duration(rand.Float64()*failureBackoffJitter*float64(delay))
+}
+
+// Returns how long until a failed sync is due to be retried, or 0 if it's due now.
+// A spec change may fix the failure, so the backoff doesn't apply once the spec has changed since the failed sync.
+func getFailureRetryDelay(dopplerSecret secretsv1alpha1.DopplerSecret, now time.Time) time.Duration {
+	nextRetryTime := dopplerSecret.Status.NextRetryTime
+	if nextRetryTime == nil || dopplerSecret.Generation != dopplerSecret.Status.ObservedGeneration {
+		return 0
+	}
+	return max(nextRetryTime.Sub(now), 0)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+	"github.com/DopplerHQ/kubernetes-operator/pkg/api"
+)
+
+func TestFailureBackoffDelay(t *testing.T) {
+	backoff := FailureBackoff{Base: 5 * time.Second, Max: time.Minute, MaxNonRetryable: time.Hour}
+	networkErr := &api.APIError{Message: "Unable to load response", Class: api.ErrorClassNetwork}
+	unauthorizedErr := &api.APIError{Message: "Invalid Service token", StatusCode: 401, Class: api.ErrorClassUnauthorized}
+
+	tests := []struct {
+		name         string
+		failureCount int
+		err          error
+		expected     time.Duration
+	}{
+		{name: "first failure", failureCount: 1, err: networkErr, expected: 5 * time.Second},
+		{name: "third failure", failureCount: 3, err: networkErr, expected: 20 * time.Second},
+		{name: "capped", failureCount: 20, err: networkErr, expected: time.Minute},
+		{name: "other error", failureCount: 2, err: errors.New("Failed to fetch token secret reference"), expected: 10 * time.Second},
+		{name: "non-retryable", failureCount: 8, err: unauthorizedErr, expected: 640 * time.Second},
+		{name: "non-retryable capped", failureCount: 100, err: unauthorizedErr, expected: time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delay := backoff.Delay(test.failureCount, test.err)
+			minDelay := time.Duration(float64(test.expected) * (1 - failureBackoffJitter))
+			if delay > test.expected || delay < minDelay {
+				t.Errorf("expected delay between %v and %v, got %v", minDelay, test.expected, delay)
+			}
+		})
+	}
+}
+
+func TestGetFailureRetryDelay(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newDopplerSecret := func(generation int64, observedGeneration int64, nextRetryTime *metav1.Time) secretsv1alpha1.DopplerSecret {
+		return secretsv1alpha1.DopplerSecret{
+			ObjectMeta: metav1.ObjectMeta{Generation: generation},
+			Status:     secretsv1alpha1.DopplerSecretStatus{ObservedGeneration: observedGeneration, NextRetryTime: nextRetryTime},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		dopplerSecret secretsv1alpha1.DopplerSecret
+		expected      time.Duration
+	}{
+		{name: "not failing", dopplerSecret: newDopplerSecret(1, 1, nil), expected: 0},
+		{name: "retry pending", dopplerSecret: newDopplerSecret(1, 1, &metav1.Time{Time: now.Add(time.Minute)}), expected: time.Minute},
+		{name: "retry due", dopplerSecret: newDopplerSecret(1, 1, &metav1.Time{Time: now.Add(-time.Second)}), expected: 0},
+		{name: "spec changed", dopplerSecret: newDopplerSecret(2, 1, &metav1.Time{Time: now.Add(time.Minute)}), expected: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if delay := getFailureRetryDelay(test.dopplerSecret, now); delay != test.expected {
+				t.Errorf("expected delay %v, got %v", test.expected, delay)
+			}
+		})
+	}
+}
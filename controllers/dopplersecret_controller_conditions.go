@@ -17,20 +17,25 @@ limitations under the License.
 package controllers
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+	"github.com/DopplerHQ/kubernetes-operator/pkg/api"
 )
 
-func (r *DopplerSecretReconciler) SetSecretsSyncReadyCondition(ctx context.Context, dopplerSecret *secretsv1alpha1.DopplerSecret, updateSecretsError error) {
+func (r *DopplerSecretReconciler) SetSecretsSyncReadyCondition(ctx context.Context, dopplerSecret *secretsv1alpha1.DopplerSecret, syncResult SecretSyncResult, updateSecretsError error) {
 	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName())
 	if dopplerSecret.Status.Conditions == nil {
 		dopplerSecret.Status.Conditions = []metav1.Condition{}
 	}
+	setSecretSyncStatus(&dopplerSecret.Status, *dopplerSecret, syncResult, updateSecretsError, r.getFailureBackoff(), metav1.Now())
 	if updateSecretsError == nil {
 		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
 			Type:    "secrets.doppler.com/SecretSyncReady",
@@ -42,14 +47,50 @@ func (r *DopplerSecretReconciler) SetSecretsSyncReadyCondition(ctx context.Conte
 		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
 			Type:    "secrets.doppler.com/SecretSyncReady",
 			Status:  metav1.ConditionFalse,
-			Reason:  "Error",
+			Reason:  getSecretSyncErrorReason(updateSecretsError),
 			Message: fmt.Sprintf("Secret update failed: %v", updateSecretsError),
 		})
 		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
 			Type:    "secrets.doppler.com/DeploymentReloadReady",
 			Status:  metav1.ConditionFalse,
 			Reason:  "Stopped",
-			Message: "Deployment reload has been stopped due to secrets sync failure",
+			Message: "Workload reload has been stopped due to secrets sync failure",
+		})
+	}
+	var ownershipConflict *OwnershipConflictError
+	if errors.As(updateSecretsError, &ownershipConflict) {
+		reason := "ManagedByOther"
+		if ownershipConflict.ManagedBy == "" {
+			reason = "NotManaged"
+		}
+		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
+			Type:    "secrets.doppler.com/OwnershipConflict",
+			Status:  metav1.ConditionTrue,
+			Reason:  reason,
+			Message: ownershipConflict.Error(),
+		})
+	} else if updateSecretsError == nil {
+		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
+			Type:    "secrets.doppler.com/OwnershipConflict",
+			Status:  metav1.ConditionFalse,
+			Reason:  "OK",
+			Message: "The managed secret is managed by this DopplerSecret",
+		})
+	}
+	var managedSecretConflict *ManagedSecretConflictError
+	if errors.As(updateSecretsError, &managedSecretConflict) {
+		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
+			Type:    "secrets.doppler.com/Conflict",
+			Status:  metav1.ConditionTrue,
+			Reason:  "ManagedSecretConflict",
+			Message: managedSecretConflict.Error(),
+		})
+	} else {
+		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
+			Type:    "secrets.doppler.com/Conflict",
+			Status:  metav1.ConditionFalse,
+			Reason:  "OK",
+			Message: "No other DopplerSecret takes precedence for the managed secret",
 		})
 	}
 	err := r.Client.Status().Update(ctx, dopplerSecret)
@@ -58,28 +99,93 @@ func (r *DopplerSecretReconciler) SetSecretsSyncReadyCondition(ctx context.Conte
 	}
 }
 
-func (r *DopplerSecretReconciler) SetDeploymentReloadReadyCondition(ctx context.Context, dopplerSecret *secretsv1alpha1.DopplerSecret, numDeployments int, deploymentError error) {
+func (r *DopplerSecretReconciler) SetDeploymentReloadReadyCondition(ctx context.Context, dopplerSecret *secretsv1alpha1.DopplerSecret, reloadResult WorkloadReloadResult, workloadError error) {
 	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName())
 	if dopplerSecret.Status.Conditions == nil {
 		dopplerSecret.Status.Conditions = []metav1.Condition{}
 	}
-	if deploymentError == nil {
+	if workloadError == nil {
+		message := fmt.Sprintf("Controller is ready to reload workloads. %v found.", len(reloadResult.Workloads))
+		if reloadResult.NumPending > 0 {
+			message = fmt.Sprintf("%s %v waiting to be restarted.", message, reloadResult.NumPending)
+		}
 		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
 			Type:    "secrets.doppler.com/DeploymentReloadReady",
 			Status:  metav1.ConditionTrue,
 			Reason:  "OK",
-			Message: fmt.Sprintf("Controller is ready to reload deployments. %v found.", numDeployments),
+			Message: message,
 		})
+		if len(reloadResult.FailedWorkloads) == 0 {
+			meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
+				Type:    "secrets.doppler.com/WorkloadRolloutHealthy",
+				Status:  metav1.ConditionTrue,
+				Reason:  "OK",
+				Message: "No restarted workloads have failed to roll out",
+			})
+		} else {
+			meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
+				Type:    "secrets.doppler.com/WorkloadRolloutHealthy",
+				Status:  metav1.ConditionFalse,
+				Reason:  "RolloutFailed",
+				Message: fmt.Sprintf("Restarted workloads failed to roll out: %s", strings.Join(reloadResult.FailedWorkloads, ", ")),
+			})
+		}
+		dopplerSecret.Status.Workloads = reloadResult.Workloads
 	} else {
 		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
 			Type:    "secrets.doppler.com/DeploymentReloadReady",
 			Status:  metav1.ConditionFalse,
 			Reason:  "Error",
-			Message: fmt.Sprintf("Deployment reconcile failed: %v", deploymentError),
+			Message: fmt.Sprintf("Workload reconcile failed: %v", workloadError),
 		})
 	}
 	err := r.Client.Status().Update(ctx, dopplerSecret)
 	if err != nil {
-		log.Error(err, "Unable to set reconcile deployments condition")
+		log.Error(err, "Unable to set reconcile workloads condition")
+	}
+}
+
+// Returns the SecretSyncReady condition reason for a sync error. Doppler API errors use their class so alerts can tell
+// a revoked token (Unauthorized) apart from an outage (ServerError or Network).
+func getSecretSyncErrorReason(updateSecretsError error) string {
+	var apiErr *api.APIError
+	if errors.As(updateSecretsError, &apiErr) && apiErr.Class != "" {
+		return string(apiErr.Class)
+	}
+	var ownershipConflict *OwnershipConflictError
+	if errors.As(updateSecretsError, &ownershipConflict) {
+		return "OwnershipConflict"
+	}
+	var managedSecretConflict *ManagedSecretConflictError
+	if errors.As(updateSecretsError, &managedSecretConflict) {
+		return "Conflict"
+	}
+	return "Error"
+}
+
+// Records the outcome of a sync attempt in the status, including when to retry a failed sync
+func setSecretSyncStatus(status *secretsv1alpha1.DopplerSecretStatus, dopplerSecret secretsv1alpha1.DopplerSecret, syncResult SecretSyncResult, updateSecretsError error, backoff FailureBackoff, now metav1.Time) {
+	if status.ObservedGeneration != dopplerSecret.Generation {
+		// The spec changed, so earlier failures may no longer apply
+		status.FailureCount = 0
+	}
+	status.ObservedGeneration = dopplerSecret.Generation
+	status.LastAttemptTime = &now
+	if updateSecretsError != nil {
+		status.FailureCount++
+		status.NextRetryTime = &metav1.Time{Time: now.Add(backoff.Delay(status.FailureCount, updateSecretsError))}
+		return
+	}
+	status.LastSuccessfulSyncTime = &now
+	status.FailureCount = 0
+	status.NextRetryTime = nil
+	status.ETag = syncResult.ETag
+	status.KeyCount = syncResult.KeyCount
+	// The project and config are only known when secrets are fetched, otherwise they're kept from the last fetch or taken from the spec
+	if project := cmp.Or(syncResult.Project, dopplerSecret.Spec.Project); project != "" {
+		status.Project = project
+	}
+	if config := cmp.Or(syncResult.Config, dopplerSecret.Spec.Config); config != "" {
+		status.Config = config
 	}
 }
@@ -0,0 +1,76 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+	"github.com/DopplerHQ/kubernetes-operator/pkg/api"
+)
+
+func TestSetSecretSyncStatus(t *testing.T) {
+	dopplerSecret := secretsv1alpha1.DopplerSecret{
+		ObjectMeta: metav1.ObjectMeta{Generation: 3},
+		Spec:       secretsv1alpha1.DopplerSecretSpec{Config: "prd"},
+	}
+	status := secretsv1alpha1.DopplerSecretStatus{}
+	now := metav1.Now()
+
+	setSecretSyncStatus(&status, dopplerSecret, SecretSyncResult{}, errors.New("sync failed"), DefaultFailureBackoff, now)
+	setSecretSyncStatus(&status, dopplerSecret, SecretSyncResult{}, errors.New("sync failed"), DefaultFailureBackoff, now)
+	if status.FailureCount != 2 || status.LastSuccessfulSyncTime != nil || status.ObservedGeneration != 3 {
+		t.Errorf("unexpected status after failures: %+v", status)
+	}
+
+	setSecretSyncStatus(&status, dopplerSecret, SecretSyncResult{ETag: "etag", Project: "backend", KeyCount: 4}, nil, DefaultFailureBackoff, now)
+	if status.FailureCount != 0 || status.LastSuccessfulSyncTime == nil || status.ETag != "etag" || status.KeyCount != 4 {
+		t.Errorf("unexpected status after success: %+v", status)
+	}
+	if status.Project != "backend" || status.Config != "prd" {
+		t.Errorf("expected project and config backend/prd, got %s/%s", status.Project, status.Config)
+	}
+
+	// Secrets which weren't fetched don't change the resolved project
+	setSecretSyncStatus(&status, dopplerSecret, SecretSyncResult{ETag: "etag", KeyCount: 4}, nil, DefaultFailureBackoff, now)
+	if status.Project != "backend" {
+		t.Errorf("expected project to be kept, got %s", status.Project)
+	}
+}
+
+func TestGetSecretSyncErrorReason(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{err: &api.APIError{Message: "Invalid Service token", StatusCode: 401, Class: api.ErrorClassUnauthorized}, expected: "Unauthorized"},
+		{err: fmt.Errorf("Failed to get API context: %w", &api.APIError{Message: "OIDC auth failed", StatusCode: 503, Class: api.ErrorClassServerError}), expected: "ServerError"},
+		{err: &api.APIError{Message: "Unable to load response"}, expected: "Error"},
+		{err: &OwnershipConflictError{Secret: "default/tls"}, expected: "OwnershipConflict"},
+		{err: &ManagedSecretConflictError{Secret: "default/app"}, expected: "Conflict"},
+		{err: errors.New("Failed to fetch token secret reference"), expected: "Error"},
+	}
+	for _, test := range tests {
+		if reason := getSecretSyncErrorReason(test.err); reason != test.expected {
+			t.Errorf("expected reason %q for %q, got %q", test.expected, test.err, reason)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+// ManagedSecretConflictError is returned when another DopplerSecret targeting the same managed secret takes precedence
+type ManagedSecretConflictError struct {
+	// The namespaced name of the managed secret
+	Secret string
+
+	// The DopplerSecret which syncs the managed secret
+	Winner string
+
+	// Every DopplerSecret targeting the managed secret, in order of precedence
+	DopplerSecrets []string
+}
+
+func (e *ManagedSecretConflictError) Error() string {
+	return fmt.Sprintf("Secret %s is targeted by multiple DopplerSecrets (%s). It is synced by %s, which is the oldest.",
+		e.Secret, strings.Join(e.DopplerSecrets, ", "), e.Winner)
+}
+
+// Sorts DopplerSecrets so the oldest comes first, falling back to the namespaced name for DopplerSecrets created in the same second
+func sortByManagedSecretPrecedence(dopplerSecrets []secretsv1alpha1.DopplerSecret) {
+	sort.SliceStable(dopplerSecrets, func(i, j int) bool {
+		a, b := dopplerSecrets[i], dopplerSecrets[j]
+		if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(&b.CreationTimestamp)
+		}
+		return a.GetNamespacedName() < b.GetNamespacedName()
+	})
+}
+
+// CheckManagedSecretConflict returns a ManagedSecretConflictError if other DopplerSecrets target the same managed secret
+// and one of them takes precedence. DopplerSecrets which are being deleted are ignored.
+func (r *DopplerSecretReconciler) CheckManagedSecretConflict(ctx context.Context, dopplerSecret secretsv1alpha1.DopplerSecret) error {
+	managedSecret := getManagedSecretNamespacedName(dopplerSecret).String()
+	dopplerSecrets := &secretsv1alpha1.DopplerSecretList{}
+	if err := r.Client.List(ctx, dopplerSecrets, client.MatchingFields{dopplerSecretManagedSecretIndexField: managedSecret}); err != nil {
+		return fmt.Errorf("Unable to find DopplerSecrets targeting the managed secret: %w", err)
+	}
+	candidates := []secretsv1alpha1.DopplerSecret{}
+	for _, candidate := range dopplerSecrets.Items {
+		if candidate.GetDeletionTimestamp() == nil && candidate.UID != dopplerSecret.UID {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	candidates = append(candidates, dopplerSecret)
+	sortByManagedSecretPrecedence(candidates)
+	if candidates[0].UID == dopplerSecret.UID {
+		return nil
+	}
+	names := []string{}
+	for _, candidate := range candidates {
+		names = append(names, candidate.GetNamespacedName())
+	}
+	conflict := &ManagedSecretConflictError{
+		Secret:         managedSecret,
+		Winner:         candidates[0].GetNamespacedName(),
+		DopplerSecrets: names,
+	}
+	r.recordEvent(&dopplerSecret, corev1.EventTypeWarning, eventReasonManagedSecretConflict, "%v", conflict)
+	return conflict
+}
+
+// Maps an event for a DopplerSecret to the other DopplerSecrets targeting the same managed secret, so the next DopplerSecret
+// takes over when the winner is deleted or retargeted. The managed secret last synced by the DopplerSecret is included
+// as it's only recorded in the status once the new target has been synced.
+func (r *DopplerSecretReconciler) mapDopplerSecretToConflicts(ctx context.Context, obj client.Object) []reconcile.Request {
+	dopplerSecret, ok := obj.(*secretsv1alpha1.DopplerSecret)
+	if !ok {
+		return nil
+	}
+	keys := []string{getManagedSecretNamespacedName(*dopplerSecret).String()}
+	if synced := dopplerSecret.Status.ManagedSecret; synced != nil {
+		if key := (types.NamespacedName{Namespace: synced.Namespace, Name: synced.Name}).String(); key != keys[0] {
+			keys = append(keys, key)
+		}
+	}
+	requests := []reconcile.Request{}
+	seen := map[types.NamespacedName]bool{}
+	for _, key := range keys {
+		dopplerSecrets := &secretsv1alpha1.DopplerSecretList{}
+		if err := r.Client.List(ctx, dopplerSecrets, client.MatchingFields{dopplerSecretManagedSecretIndexField: key}); err != nil {
+			r.Log.Error(err, "Unable to find DopplerSecrets for managed secret", "secret", key)
+			continue
+		}
+		for _, other := range dopplerSecrets.Items {
+			namespacedName := types.NamespacedName{Namespace: other.Namespace, Name: other.Name}
+			if other.UID == dopplerSecret.UID || seen[namespacedName] {
+				continue
+			}
+			seen[namespacedName] = true
+			requests = append(requests, reconcile.Request{NamespacedName: namespacedName})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+func TestSortByManagedSecretPrecedence(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	newDopplerSecret := func(namespace string, name string, created time.Time) secretsv1alpha1.DopplerSecret {
+		return secretsv1alpha1.DopplerSecret{ObjectMeta: metav1.ObjectMeta{
+			Namespace:         namespace,
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(created),
+		}}
+	}
+	dopplerSecrets := []secretsv1alpha1.DopplerSecret{
+		newDopplerSecret("default", "newest", now),
+		newDopplerSecret("default", "b", now.Add(-time.Hour)),
+		newDopplerSecret("default", "a", now.Add(-time.Hour)),
+		newDopplerSecret("other", "oldest", now.Add(-2*time.Hour)),
+	}
+
+	sortByManagedSecretPrecedence(dopplerSecrets)
+
+	names := []string{}
+	for _, dopplerSecret := range dopplerSecrets {
+		names = append(names, dopplerSecret.GetNamespacedName())
+	}
+	expected := []string{"other/oldest", "default/a", "default/b", "default/newest"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestMapDopplerSecretToConflictsOnRetarget(t *testing.T) {
+	newDopplerSecret := func(name string, managedSecretName string) *secretsv1alpha1.DopplerSecret {
+		dopplerSecret := newTestDopplerSecret("default", name, "", managedSecretName)
+		dopplerSecret.UID = types.UID(name)
+		dopplerSecret.Generation = 1
+		return dopplerSecret
+	}
+	// The winner was syncing old-secret and has been pointed at new-secret, which it hasn't synced yet
+	winner := newDopplerSecret("winner", "new-secret")
+	winner.Status.ManagedSecret = &secretsv1alpha1.ManagedSecretStatus{Namespace: "default", Name: "old-secret"}
+	fakeClient := newTestIndexedClientBuilder(t).
+		WithObjects(
+			winner,
+			newDopplerSecret("waiting-for-old", "old-secret"),
+			newDopplerSecret("waiting-for-new", "new-secret"),
+			newDopplerSecret("unrelated", "unrelated-secret"),
+		).
+		Build()
+	r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard()}
+	eventHandler := handler.EnqueueRequestsFromMapFunc(r.mapDopplerSecretToConflicts)
+
+	synced := winner.DeepCopy()
+	synced.Spec.ManagedSecretRef.Name = "old-secret"
+	// The spec was changed twice before the first change was synced, so the old object doesn't target the synced secret either
+	interim := winner.DeepCopy()
+	interim.Spec.ManagedSecretRef.Name = "interim-secret"
+	retargeted := winner.DeepCopy()
+	retargeted.Generation = 2
+
+	tests := []struct {
+		name     string
+		event    interface{}
+		expected []string
+	}{
+		{
+			name:     "retargeted",
+			event:    event.UpdateEvent{ObjectOld: synced, ObjectNew: retargeted},
+			expected: []string{"default/waiting-for-new", "default/waiting-for-old"},
+		},
+		{
+			name:     "retargeted again before the previous target was synced",
+			event:    event.UpdateEvent{ObjectOld: interim, ObjectNew: retargeted},
+			expected: []string{"default/waiting-for-new", "default/waiting-for-old"},
+		},
+		{
+			name:     "deleted before the new target was synced",
+			event:    event.DeleteEvent{Object: winner},
+			expected: []string{"default/waiting-for-new", "default/waiting-for-old"},
+		},
+		{
+			name:     "created by a restarted operator",
+			event:    event.CreateEvent{Object: winner},
+			expected: []string{"default/waiting-for-new", "default/waiting-for-old"},
+		},
+		{
+			name:     "status updated",
+			event:    event.UpdateEvent{ObjectOld: winner, ObjectNew: winner.DeepCopy()},
+			expected: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := getWatchRequestNames(t, eventHandler, predicate.GenerationChangedPredicate{}, test.event)
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+
+	// Once the new target is synced, only the DopplerSecrets targeting it are mapped
+	winner.Status.ManagedSecret = &secretsv1alpha1.ManagedSecretStatus{Namespace: "default", Name: "new-secret"}
+	actual := getRequestNames(r.mapDopplerSecretToConflicts(context.Background(), winner))
+	if !reflect.DeepEqual(actual, []string{"default/waiting-for-new"}) {
+		t.Errorf("expected only default/waiting-for-new, got %v", actual)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+const (
+	// The managed secret was created or updated from Doppler
+	eventReasonSecretsSynced = "SecretsSynced"
+	// The operator was unable to authenticate with Doppler
+	eventReasonAuthFailed = "AuthFailed"
+	// A workload using the managed secret was restarted to pick up new secrets
+	eventReasonWorkloadRestarted = "WorkloadRestarted"
+	// The managed secret was modified outside of the operator and has been restored
+	eventReasonDriftCorrected = "DriftCorrected"
+	// The managed secret exists but isn't managed by the DopplerSecret
+	eventReasonOwnershipConflict = "OwnershipConflict"
+	// Another DopplerSecret targeting the same managed secret takes precedence
+	eventReasonManagedSecretConflict = "ManagedSecretConflict"
+	// The deletion policy was applied to a managed secret which is no longer managed by the DopplerSecret
+	eventReasonManagedSecretRetained = "ManagedSecretRetained"
+	eventReasonManagedSecretDeleted  = "ManagedSecretDeleted"
+	eventReasonManagedSecretOrphaned = "ManagedSecretOrphaned"
+	// The managed secret reference changed and the deletion policy was applied to the previous secret
+	eventReasonManagedSecretRetargeted = "ManagedSecretRetargeted"
+	// Workloads still use the previous managed secret after the managed secret reference changed
+	eventReasonPreviousSecretInUse = "PreviousSecretInUse"
+	// A secret created by the operator is managed by a DopplerSecret which no longer exists
+	eventReasonOrphanedSecret = "OrphanedSecret"
+	// An orphaned secret was deleted after its grace period
+	eventReasonOrphanedSecretDeleted = "OrphanedSecretDeleted"
+)
+
+// Records an event on the object if the reconciler has an event recorder
+func (r *DopplerSecretReconciler) recordEvent(object runtime.Object, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+// Records an event on the DopplerSecret and on its managed secret, if it exists, so it's visible from either object
+func (r *DopplerSecretReconciler) recordSyncEvent(dopplerSecret *secretsv1alpha1.DopplerSecret, secret *corev1.Secret, eventType string, reason string, messageFmt string, args ...interface{}) {
+	r.recordEvent(dopplerSecret, eventType, reason, messageFmt, args...)
+	if secret != nil {
+		r.recordEvent(secret, eventType, reason, messageFmt, args...)
+	}
+}
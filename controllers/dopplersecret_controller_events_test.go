@@ -0,0 +1,323 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+// Returns the events recorded so far, formatted as "<type> <reason> <message>"
+func getRecordedEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	return events
+}
+
+func TestUpdateSecretRecordsSyncEvents(t *testing.T) {
+	ctx := context.Background()
+	r, dopplerAPI, dopplerSecret := newTestRollbackReconciler(t)
+	recorder := r.Recorder.(*record.FakeRecorder)
+
+	dopplerAPI.setSecrets("v1", map[string]string{"API_KEY": "one", "DB_URL": "postgres://one"})
+	if _, err := r.UpdateSecret(ctx, *dopplerSecret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events := getRecordedEvents(recorder)
+	// Recorded on both the DopplerSecret and the managed secret
+	if len(events) != 2 || events[0] != events[1] {
+		t.Fatalf("expected the same event on the DopplerSecret and the managed secret, got %v", events)
+	}
+	if !strings.HasPrefix(events[0], "Normal SecretsSynced Created managed secret default/managed at version v1 with 2 keys.") {
+		t.Errorf("unexpected event %q", events[0])
+	}
+
+	dopplerAPI.setSecrets("v2", map[string]string{"API_KEY": "two", "NEW_KEY": "new"})
+	if _, err := r.UpdateSecret(ctx, *dopplerSecret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "Normal SecretsSynced Updated managed secret default/managed to version v2: 1 added, 1 removed, 1 changed. " +
+		"Added: NEW_KEY. Removed: DB_URL. Changed: API_KEY."
+	if events := getRecordedEvents(recorder); !reflect.DeepEqual(events, []string{expected, expected}) {
+		t.Errorf("expected %q on both objects, got %v", expected, events)
+	}
+
+	// Nothing is recorded when the secrets haven't changed
+	if _, err := r.UpdateSecret(ctx, *dopplerSecret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events := getRecordedEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+}
+
+func TestUpdateSecretRecordsDriftEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		synced  bool
+		drift   func(t *testing.T, r *DopplerSecretReconciler)
+		reasons []string
+		message string
+	}{
+		{
+			name:   "data modified",
+			synced: true,
+			drift: func(t *testing.T, r *DopplerSecretReconciler) {
+				managedSecret := getTestSecret(t, r, "managed")
+				managedSecret.Data["API_KEY"] = []byte("tampered")
+				if err := r.Client.Update(context.Background(), managedSecret); err != nil {
+					t.Fatalf("unable to update managed secret: %v", err)
+				}
+			},
+			reasons: []string{eventReasonSecretsSynced, eventReasonSecretsSynced, eventReasonDriftCorrected, eventReasonDriftCorrected},
+			message: "Warning DriftCorrected Managed secret default/managed was modified outside of the operator and has been restored",
+		},
+		{
+			name:   "key added by others",
+			synced: true,
+			drift: func(t *testing.T, r *DopplerSecretReconciler) {
+				managedSecret := getTestSecret(t, r, "managed")
+				managedSecret.Data["ADDED_BY_OTHERS"] = []byte("other")
+				if err := r.Client.Update(context.Background(), managedSecret); err != nil {
+					t.Fatalf("unable to update managed secret: %v", err)
+				}
+			},
+			reasons: []string{},
+		},
+		{
+			name:   "deleted",
+			synced: true,
+			drift: func(t *testing.T, r *DopplerSecretReconciler) {
+				if err := r.Client.Delete(context.Background(), getTestSecret(t, r, "managed")); err != nil {
+					t.Fatalf("unable to delete managed secret: %v", err)
+				}
+			},
+			reasons: []string{eventReasonSecretsSynced, eventReasonSecretsSynced, eventReasonDriftCorrected, eventReasonDriftCorrected},
+			message: "Warning DriftCorrected Managed secret default/managed was deleted outside of the operator and has been recreated",
+		},
+		{
+			name: "deleted before the DopplerSecret recorded it",
+			drift: func(t *testing.T, r *DopplerSecretReconciler) {
+				if err := r.Client.Delete(context.Background(), getTestSecret(t, r, "managed")); err != nil {
+					t.Fatalf("unable to delete managed secret: %v", err)
+				}
+			},
+			reasons: []string{eventReasonSecretsSynced, eventReasonSecretsSynced},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			r, dopplerAPI, dopplerSecret := newTestRollbackReconciler(t)
+			recorder := r.Recorder.(*record.FakeRecorder)
+			dopplerAPI.setSecrets("v1", map[string]string{"API_KEY": "one"})
+			if _, err := r.UpdateSecret(ctx, *dopplerSecret); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			getRecordedEvents(recorder)
+			if test.synced {
+				dopplerSecret.Status.ManagedSecret = &secretsv1alpha1.ManagedSecretStatus{Name: "managed", Namespace: "default"}
+			}
+
+			test.drift(t, r)
+			if _, err := r.UpdateSecret(ctx, *dopplerSecret); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			events := getRecordedEvents(recorder)
+			reasons := []string{}
+			for _, event := range events {
+				reasons = append(reasons, strings.Fields(event)[1])
+			}
+			if !reflect.DeepEqual(reasons, test.reasons) {
+				t.Fatalf("expected events %v, got %v", test.reasons, events)
+			}
+			if test.message != "" && (events[2] != test.message || events[3] != test.message) {
+				t.Errorf("expected %q on both objects, got %v", test.message, events[2:])
+			}
+			if data := getTestSecret(t, r, "managed").Data; string(data["API_KEY"]) != "one" {
+				t.Errorf("expected the managed secret to be restored, got %v", data)
+			}
+		})
+	}
+}
+
+func TestUpdateSecretRecordsAuthFailedEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    func(t *testing.T, r *DopplerSecretReconciler, dopplerSecret *secretsv1alpha1.DopplerSecret)
+		message string
+	}{
+		{
+			name: "token secret missing",
+			fail: func(t *testing.T, r *DopplerSecretReconciler, dopplerSecret *secretsv1alpha1.DopplerSecret) {
+				tokenSecret := &corev1.Secret{}
+				if err := r.Client.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "doppler-token"}, tokenSecret); err != nil {
+					t.Fatalf("unable to fetch token secret: %v", err)
+				}
+				if err := r.Client.Delete(context.Background(), tokenSecret); err != nil {
+					t.Fatalf("unable to delete token secret: %v", err)
+				}
+			},
+			message: "Warning AuthFailed Unable to authenticate with Doppler",
+		},
+		{
+			name: "token rejected",
+			fail: func(t *testing.T, r *DopplerSecretReconciler, dopplerSecret *secretsv1alpha1.DopplerSecret) {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					w.WriteHeader(http.StatusUnauthorized)
+				}))
+				t.Cleanup(server.Close)
+				dopplerSecret.Spec.Host = server.URL
+			},
+			message: "Warning AuthFailed Doppler rejected the token",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			r, dopplerAPI, dopplerSecret := newTestRollbackReconciler(t)
+			recorder := r.Recorder.(*record.FakeRecorder)
+			dopplerAPI.setSecrets("v1", map[string]string{"API_KEY": "one"})
+			if _, err := r.UpdateSecret(ctx, *dopplerSecret); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			getRecordedEvents(recorder)
+
+			test.fail(t, r, dopplerSecret)
+			if _, err := r.UpdateSecret(ctx, *dopplerSecret); err == nil {
+				t.Fatalf("expected an error")
+			}
+			events := getRecordedEvents(recorder)
+			if len(events) != 2 || events[0] != events[1] {
+				t.Fatalf("expected the same event on the DopplerSecret and the managed secret, got %v", events)
+			}
+			if !strings.HasPrefix(events[0], test.message) {
+				t.Errorf("expected an event starting with %q, got %q", test.message, events[0])
+			}
+		})
+	}
+}
+
+func TestUpdateSecretRecordsOwnershipConflictEvent(t *testing.T) {
+	ctx := context.Background()
+	r, dopplerAPI, dopplerSecret := newTestRollbackReconciler(t)
+	recorder := r.Recorder.(*record.FakeRecorder)
+	dopplerAPI.setSecrets("v1", map[string]string{"API_KEY": "doppler"})
+	if err := r.Client.Create(ctx, newTestOperatorSecret("managed", "default/other", "dopplerSecret")); err != nil {
+		t.Fatalf("unable to create secret: %v", err)
+	}
+
+	if _, err := r.UpdateSecret(ctx, *dopplerSecret); err == nil {
+		t.Fatalf("expected an ownership conflict")
+	}
+	// The secret belongs to another DopplerSecret, so only the DopplerSecret gets the event
+	events := getRecordedEvents(recorder)
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning OwnershipConflict ") || !strings.Contains(events[0], "default/other") {
+		t.Errorf("expected a single ownership conflict event naming the other DopplerSecret, got %v", events)
+	}
+}
+
+func TestCheckManagedSecretConflictRecordsEvent(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	newDopplerSecret := func(name string, created time.Time) *secretsv1alpha1.DopplerSecret {
+		dopplerSecret := newTestDopplerSecret("default", name, "", "app-secret")
+		dopplerSecret.UID = types.UID(name)
+		dopplerSecret.CreationTimestamp = metav1.NewTime(created)
+		return dopplerSecret
+	}
+	winner := newDopplerSecret("winner", now.Add(-time.Hour))
+	loser := newDopplerSecret("loser", now)
+	recorder := record.NewFakeRecorder(10)
+	r := &DopplerSecretReconciler{
+		Client:   newTestIndexedClientBuilder(t).WithObjects(winner, loser).Build(),
+		Log:      logr.Discard(),
+		Recorder: recorder,
+	}
+
+	if err := r.CheckManagedSecretConflict(context.Background(), *winner); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events := getRecordedEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no events for the DopplerSecret which takes precedence, got %v", events)
+	}
+
+	if err := r.CheckManagedSecretConflict(context.Background(), *loser); err == nil {
+		t.Fatalf("expected a managed secret conflict")
+	}
+	expected := "Warning ManagedSecretConflict Secret default/app-secret is targeted by multiple DopplerSecrets (default/winner, default/loser). " +
+		"It is synced by default/winner, which is the oldest."
+	if events := getRecordedEvents(recorder); !reflect.DeepEqual(events, []string{expected}) {
+		t.Errorf("expected %q, got %v", expected, events)
+	}
+}
+
+func TestReconcileWorkloadsUsingSecretRecordsRestartEvents(t *testing.T) {
+	secretVersion := "W/\"v2\""
+	dopplerSecret := newTestDopplerSecret("default", "app", "", testSecretName)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        testSecretName,
+		Annotations: map[string]string{kubeSecretVersionAnnotation: secretVersion},
+	}}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "api", Annotations: map[string]string{workloadRestartAnnotation: "true"}},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", EnvFrom: []corev1.EnvFromSource{secretEnvFrom(testSecretName)}}},
+		}}},
+	}
+	recorder := record.NewFakeRecorder(10)
+	r := &DopplerSecretReconciler{
+		Client:   newTestWorkloadClientBuilder(t).WithObjects(dopplerSecret, secret, deployment).Build(),
+		Log:      logr.Discard(),
+		Recorder: recorder,
+		Rollouts: NewRolloutOrchestrator(0),
+	}
+
+	if _, err := r.ReconcileWorkloadsUsingSecret(context.Background(), *dopplerSecret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "Normal WorkloadRestarted Restarted Deployment default/api with the annotation strategy to load secret version " + secretVersion
+	if events := getRecordedEvents(recorder); !reflect.DeepEqual(events, []string{expected, expected}) {
+		t.Errorf("expected %q on both objects, got %v", expected, events)
+	}
+
+	// The workload already runs the current version, so it isn't restarted again
+	if _, err := r.ReconcileWorkloadsUsingSecret(context.Background(), *dopplerSecret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events := getRecordedEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+// DeletionPolicy is what happens to a managed secret when the DopplerSecret managing it is deleted
+type DeletionPolicy string
+
+const (
+	// Leaves the managed secret as is
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// Deletes the managed secret
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// Leaves the managed secret in place with the orphaned label
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+)
+
+const (
+	dopplerSecretFinalizer        = "secrets.doppler.com/finalizer"
+	kubeSecretOrphanedLabel       = "secrets.doppler.com/orphaned"
+	kubeSecretDeletionPolicyLabel = "secrets.doppler.com/deletion-policy"
+)
+
+var deletionPolicyEventReasons = map[DeletionPolicy]string{
+	DeletionPolicyRetain: eventReasonManagedSecretRetained,
+	DeletionPolicyDelete: eventReasonManagedSecretDeleted,
+	DeletionPolicyOrphan: eventReasonManagedSecretOrphaned,
+}
+
+func getDeletionPolicy(dopplerSecret secretsv1alpha1.DopplerSecret) DeletionPolicy {
+	if dopplerSecret.Spec.ManagedSecretRef.DeletionPolicy == "" {
+		return DeletionPolicyRetain
+	}
+	return DeletionPolicy(dopplerSecret.Spec.ManagedSecretRef.DeletionPolicy)
+}
+
+// ReconcileFinalizer adds the finalizer to DopplerSecrets whose managed secret must be cleaned up on deletion and removes it otherwise
+func (r *DopplerSecretReconciler) ReconcileFinalizer(ctx context.Context, dopplerSecret *secretsv1alpha1.DopplerSecret) error {
+	var updated bool
+	if getDeletionPolicy(*dopplerSecret) == DeletionPolicyRetain {
+		updated = controllerutil.RemoveFinalizer(dopplerSecret, dopplerSecretFinalizer)
+	} else {
+		updated = controllerutil.AddFinalizer(dopplerSecret, dopplerSecretFinalizer)
+	}
+	if !updated {
+		return nil
+	}
+	if err := r.Client.Update(ctx, dopplerSecret); err != nil {
+		return fmt.Errorf("Unable to update finalizer: %w", err)
+	}
+	return nil
+}
+
+// ReconcileDeletion applies the deletion policy to the managed secret of a deleted DopplerSecret and then removes the finalizer
+func (r *DopplerSecretReconciler) ReconcileDeletion(ctx context.Context, dopplerSecret *secretsv1alpha1.DopplerSecret) error {
+	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName())
+	r.Rollouts.forget(types.NamespacedName{Namespace: dopplerSecret.Namespace, Name: dopplerSecret.Name})
+	if !controllerutil.ContainsFinalizer(dopplerSecret, dopplerSecretFinalizer) {
+		log.Info("dopplersecret has been deleted, nothing to do")
+		return nil
+	}
+
+	policy := getDeletionPolicy(*dopplerSecret)
+	managedSecret := getManagedSecretNamespacedName(*dopplerSecret)
+	message, err := r.ApplyDeletionPolicy(ctx, *dopplerSecret, managedSecret, policy)
+	if err != nil {
+		return err
+	}
+	log.Info("[/] Applied managed secret deletion policy", "policy", policy, "secret", managedSecret.String())
+	r.recordEvent(dopplerSecret, corev1.EventTypeNormal, deletionPolicyEventReasons[policy], "%s", message)
+	r.SetDeletionPolicyCondition(ctx, dopplerSecret, policy, message)
+
+	controllerutil.RemoveFinalizer(dopplerSecret, dopplerSecretFinalizer)
+	if err := r.Client.Update(ctx, dopplerSecret); err != nil {
+		return fmt.Errorf("Unable to remove finalizer: %w", err)
+	}
+	return nil
+}
+
+// ApplyDeletionPolicy deletes or orphans a secret which is no longer managed by the DopplerSecret, along with its previous secret.
+// Secrets which are managed by another DopplerSecret are left untouched. Returns a message describing what was done.
+func (r *DopplerSecretReconciler) ApplyDeletionPolicy(ctx context.Context, dopplerSecret secretsv1alpha1.DopplerSecret, secretName types.NamespacedName, policy DeletionPolicy) (string, error) {
+	if policy == DeletionPolicyRetain {
+		return fmt.Sprintf("Retained managed secret %s", secretName), nil
+	}
+	secret, err := r.GetReferencedSecret(ctx, secretName)
+	if errors.IsNotFound(err) {
+		return fmt.Sprintf("Managed secret %s no longer exists", secretName), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to fetch managed secret: %w", err)
+	}
+	if managedBy := secret.Annotations[kubeSecretManagedByAnnotation]; managedBy != dopplerSecret.GetNamespacedName() {
+		return fmt.Sprintf("Left managed secret %s in place, it is managed by %s", secretName, managedBy), nil
+	}
+
+	// The previous secret only exists to support rollbacks, so it's never useful once the managed secret is released
+	if err := r.DeletePreviousSecret(ctx, *secret, dopplerSecret); err != nil {
+		return "", err
+	}
+
+	if policy == DeletionPolicyDelete {
+		if err := r.Client.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+			return "", fmt.Errorf("Unable to delete managed secret: %w", err)
+		}
+		return fmt.Sprintf("Deleted managed secret %s", secretName), nil
+	}
+
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[kubeSecretOrphanedLabel] = "true"
+	if err := r.Client.Update(ctx, secret); err != nil {
+		return "", fmt.Errorf("Unable to label orphaned managed secret: %w", err)
+	}
+	return fmt.Sprintf("Orphaned managed secret %s", secretName), nil
+}
+
+func (r *DopplerSecretReconciler) SetDeletionPolicyCondition(ctx context.Context, dopplerSecret *secretsv1alpha1.DopplerSecret, policy DeletionPolicy, message string) {
+	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName())
+	if dopplerSecret.Status.Conditions == nil {
+		dopplerSecret.Status.Conditions = []metav1.Condition{}
+	}
+	meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
+		Type:    "secrets.doppler.com/DeletionPolicyApplied",
+		Status:  metav1.ConditionTrue,
+		Reason:  string(policy),
+		Message: message,
+	})
+	err := r.Client.Status().Update(ctx, dopplerSecret)
+	if err != nil {
+		log.Error(err, "Unable to set deletion policy condition")
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestOperatorSecret(name string, managedBy string, subtype string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Data:       map[string][]byte{"API_KEY": []byte("value")},
+	}
+	if managedBy != "" {
+		secret.Annotations = map[string]string{kubeSecretManagedByAnnotation: managedBy}
+		secret.Labels = map[string]string{kubeSecretSubtypeLabel: subtype}
+	}
+	return secret
+}
+
+// Fetches the secret, returning nil if it doesn't exist
+func getTestSecretIfExists(t *testing.T, c client.Client, name string) *corev1.Secret {
+	t.Helper()
+	secret := &corev1.Secret{}
+	err := c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: name}, secret)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("unable to fetch secret %s: %v", name, err)
+	}
+	return secret
+}
+
+func TestApplyDeletionPolicy(t *testing.T) {
+	dopplerSecret := newTestDopplerSecret("default", "app", "", "app-secret")
+	previousSecretName := GetPreviousSecretName("app-secret")
+	tests := []struct {
+		name              string
+		policy            DeletionPolicy
+		managedBy         string
+		previousManagedBy string
+		managedDeleted    bool
+		managedOrphaned   bool
+		previousDeleted   bool
+		message           string
+	}{
+		{
+			name:              "retain",
+			policy:            DeletionPolicyRetain,
+			managedBy:         "default/app",
+			previousManagedBy: "default/app",
+			message:           "Retained managed secret",
+		},
+		{
+			name:              "delete",
+			policy:            DeletionPolicyDelete,
+			managedBy:         "default/app",
+			previousManagedBy: "default/app",
+			managedDeleted:    true,
+			previousDeleted:   true,
+			message:           "Deleted managed secret",
+		},
+		{
+			name:            "delete with a previous secret which isn't managed by the DopplerSecret",
+			policy:          DeletionPolicyDelete,
+			managedBy:       "default/app",
+			managedDeleted:  true,
+			previousDeleted: false,
+			message:         "Deleted managed secret",
+		},
+		{
+			name:              "delete with a previous secret managed by another DopplerSecret",
+			policy:            DeletionPolicyDelete,
+			managedBy:         "default/app",
+			previousManagedBy: "default/other",
+			managedDeleted:    true,
+			previousDeleted:   false,
+			message:           "Deleted managed secret",
+		},
+		{
+			name:              "orphan",
+			policy:            DeletionPolicyOrphan,
+			managedBy:         "default/app",
+			previousManagedBy: "default/app",
+			managedOrphaned:   true,
+			previousDeleted:   true,
+			message:           "Orphaned managed secret",
+		},
+		{
+			name:            "orphan with a previous secret which isn't managed by the DopplerSecret",
+			policy:          DeletionPolicyOrphan,
+			managedBy:       "default/app",
+			managedOrphaned: true,
+			previousDeleted: false,
+			message:         "Orphaned managed secret",
+		},
+		{
+			name:              "managed secret managed by another DopplerSecret",
+			policy:            DeletionPolicyDelete,
+			managedBy:         "default/other",
+			previousManagedBy: "default/app",
+			message:           "it is managed by default/other",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeClient := fake.NewClientBuilder().
+				WithScheme(newTestScheme(t)).
+				WithObjects(
+					newTestOperatorSecret("app-secret", test.managedBy, "dopplerSecret"),
+					newTestOperatorSecret(previousSecretName, test.previousManagedBy, previousSecretSubtype),
+				).
+				Build()
+			r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard()}
+
+			message, err := r.ApplyDeletionPolicy(context.Background(), *dopplerSecret, types.NamespacedName{Namespace: "default", Name: "app-secret"}, test.policy)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.Contains(message, test.message) {
+				t.Errorf("expected message to contain %q, got %q", test.message, message)
+			}
+
+			managedSecret := getTestSecretIfExists(t, fakeClient, "app-secret")
+			if (managedSecret == nil) != test.managedDeleted {
+				t.Errorf("expected managed secret deleted to be %t", test.managedDeleted)
+			}
+			if managedSecret != nil {
+				_, orphaned := managedSecret.Labels[kubeSecretOrphanedLabel]
+				if orphaned != test.managedOrphaned {
+					t.Errorf("expected managed secret orphaned to be %t, got labels %v", test.managedOrphaned, managedSecret.Labels)
+				}
+			}
+			if previousSecret := getTestSecretIfExists(t, fakeClient, previousSecretName); (previousSecret == nil) != test.previousDeleted {
+				t.Errorf("expected previous secret deleted to be %t", test.previousDeleted)
+			}
+		})
+	}
+}
+
+func TestApplyDeletionPolicyWithoutManagedSecret(t *testing.T) {
+	previousSecretName := GetPreviousSecretName("app-secret")
+	fakeClient := fake.NewClientBuilder().
+		WithScheme(newTestScheme(t)).
+		WithObjects(newTestOperatorSecret(previousSecretName, "", "")).
+		Build()
+	r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard()}
+
+	message, err := r.ApplyDeletionPolicy(context.Background(), *newTestDopplerSecret("default", "app", "", "app-secret"), types.NamespacedName{Namespace: "default", Name: "app-secret"}, DeletionPolicyDelete)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(message, "no longer exists") {
+		t.Errorf("unexpected message %q", message)
+	}
+	if getTestSecretIfExists(t, fakeClient, previousSecretName) == nil {
+		t.Errorf("expected the unmanaged previous secret to be left alone")
+	}
+}
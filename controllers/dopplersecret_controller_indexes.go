@@ -0,0 +1,194 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+const (
+	// Indexes workloads by the names of the secrets used by their pod template
+	workloadSecretNamesIndexField = ".spec.template.secretNames"
+	// Indexes DopplerSecrets by the `<namespace>/<name>` of their managed secret
+	dopplerSecretManagedSecretIndexField = ".spec.managedSecret"
+	// Indexes DopplerSecrets by their reload targets, as `<namespace>/<kind>/<name>`
+	dopplerSecretReloadTargetIndexField = ".spec.reload.targets"
+	// Indexes DopplerSecrets by the `<namespace>/<name>` of their token secret
+	dopplerSecretTokenSecretIndexField = ".spec.tokenSecret"
+)
+
+// Returns the namespaced name of a DopplerSecret's managed secret, which defaults to the DopplerSecret's namespace
+func getManagedSecretNamespacedName(dopplerSecret secretsv1alpha1.DopplerSecret) types.NamespacedName {
+	namespace := dopplerSecret.Spec.ManagedSecretRef.Namespace
+	if namespace == "" {
+		namespace = dopplerSecret.Namespace
+	}
+	return types.NamespacedName{
+		Namespace: namespace,
+		Name:      dopplerSecret.Spec.ManagedSecretRef.Name,
+	}
+}
+
+func getReloadTargetIndexKey(namespace string, kind string, name string) string {
+	return fmt.Sprintf("%s/%s/%s", namespace, kind, name)
+}
+
+// Registers the field indexes used to look up workloads and DopplerSecrets without listing every object
+func (r *DopplerSecretReconciler) setupIndexes(ctx context.Context, mgr ctrl.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	for i := range r.getWorkloadKinds() {
+		kind := &r.getWorkloadKinds()[i]
+		err := indexer.IndexField(ctx, kind.NewObject(), workloadSecretNamesIndexField, indexWorkloadBySecretNames(kind))
+		if err != nil {
+			return fmt.Errorf("Unable to index %s workloads: %w", kind.GroupVersionKind.Kind, err)
+		}
+	}
+
+	err := indexer.IndexField(ctx, &secretsv1alpha1.DopplerSecret{}, dopplerSecretManagedSecretIndexField, indexDopplerSecretByManagedSecret)
+	if err != nil {
+		return fmt.Errorf("Unable to index DopplerSecrets by managed secret: %w", err)
+	}
+
+	err = indexer.IndexField(ctx, &secretsv1alpha1.DopplerSecret{}, dopplerSecretReloadTargetIndexField, indexDopplerSecretByReloadTargets)
+	if err != nil {
+		return fmt.Errorf("Unable to index DopplerSecrets by reload target: %w", err)
+	}
+
+	err = indexer.IndexField(ctx, &secretsv1alpha1.DopplerSecret{}, dopplerSecretTokenSecretIndexField, indexDopplerSecretByTokenSecret)
+	if err != nil {
+		return fmt.Errorf("Unable to index DopplerSecrets by token secret: %w", err)
+	}
+	return nil
+}
+
+// Returns the index function for workloads of the given kind, which indexes them by the secrets used by their pod template
+func indexWorkloadBySecretNames(kind *WorkloadKind) client.IndexerFunc {
+	return func(obj client.Object) []string {
+		template, err := kind.GetPodTemplate(obj)
+		if err != nil {
+			return nil
+		}
+		return GetPodSpecSecretNames(&template.Spec)
+	}
+}
+
+func indexDopplerSecretByManagedSecret(obj client.Object) []string {
+	dopplerSecret := obj.(*secretsv1alpha1.DopplerSecret)
+	return []string{getManagedSecretNamespacedName(*dopplerSecret).String()}
+}
+
+// Reload targets are in the managed secret's namespace
+func indexDopplerSecretByReloadTargets(obj client.Object) []string {
+	dopplerSecret := obj.(*secretsv1alpha1.DopplerSecret)
+	namespace := getManagedSecretNamespacedName(*dopplerSecret).Namespace
+	keys := []string{}
+	for _, target := range dopplerSecret.Spec.Reload.Targets {
+		keys = append(keys, getReloadTargetIndexKey(namespace, target.Kind, target.Name))
+	}
+	return keys
+}
+
+// The token secret defaults to the DopplerSecret's namespace. DopplerSecrets which authenticate without a token secret aren't indexed.
+func indexDopplerSecretByTokenSecret(obj client.Object) []string {
+	dopplerSecret := obj.(*secretsv1alpha1.DopplerSecret)
+	if dopplerSecret.Spec.TokenSecretRef.Name == "" {
+		return nil
+	}
+	namespace := dopplerSecret.Spec.TokenSecretRef.Namespace
+	if namespace == "" {
+		namespace = dopplerSecret.Namespace
+	}
+	return []string{types.NamespacedName{Namespace: namespace, Name: dopplerSecret.Spec.TokenSecretRef.Name}.String()}
+}
+
+// Filters workload events to those which can affect reloading: spec changes, which include the pod template, and annotation or label changes.
+// Status updates made during rollouts are ignored.
+func workloadChangedPredicate() predicate.Predicate {
+	return predicate.Or[client.Object](predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}, predicate.LabelChangedPredicate{})
+}
+
+// Returns a function which maps an event for a workload of the given kind to the DopplerSecrets whose managed secret it uses
+// or which list it as a reload target
+func (r *DopplerSecretReconciler) mapWorkloadToDopplerSecrets(kind *WorkloadKind) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		log := r.Log.WithValues("workload", Workload{Kind: kind, Object: obj}.String())
+		if isControlledByWorkload(obj, r.getWorkloadKinds()) {
+			return nil
+		}
+
+		lookups := []client.MatchingFields{
+			{dopplerSecretReloadTargetIndexField: getReloadTargetIndexKey(obj.GetNamespace(), kind.GroupVersionKind.Kind, obj.GetName())},
+		}
+		if template, err := kind.GetPodTemplate(obj); err == nil {
+			for _, secretName := range GetPodSpecSecretNames(&template.Spec) {
+				key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: secretName}.String()
+				lookups = append(lookups, client.MatchingFields{dopplerSecretManagedSecretIndexField: key})
+			}
+		}
+
+		requests := []reconcile.Request{}
+		seen := map[types.NamespacedName]bool{}
+		for _, lookup := range lookups {
+			dopplerSecrets := &secretsv1alpha1.DopplerSecretList{}
+			if err := r.Client.List(ctx, dopplerSecrets, lookup); err != nil {
+				log.Error(err, "Unable to find DopplerSecrets for workload")
+				continue
+			}
+			for _, dopplerSecret := range dopplerSecrets.Items {
+				namespacedName := types.NamespacedName{Namespace: dopplerSecret.Namespace, Name: dopplerSecret.Name}
+				if !seen[namespacedName] {
+					seen[namespacedName] = true
+					requests = append(requests, reconcile.Request{NamespacedName: namespacedName})
+				}
+			}
+		}
+		return requests
+	}
+}
+
+// Maps an event for a secret to the DopplerSecrets which manage it or use it as their token secret,
+// so managed secrets are repaired and token rotations take effect immediately
+func (r *DopplerSecretReconciler) mapSecretToDopplerSecrets(ctx context.Context, obj client.Object) []reconcile.Request {
+	key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}.String()
+	requests := []reconcile.Request{}
+	seen := map[types.NamespacedName]bool{}
+	for _, field := range []string{dopplerSecretManagedSecretIndexField, dopplerSecretTokenSecretIndexField} {
+		dopplerSecrets := &secretsv1alpha1.DopplerSecretList{}
+		if err := r.Client.List(ctx, dopplerSecrets, client.MatchingFields{field: key}); err != nil {
+			r.Log.Error(err, "Unable to find DopplerSecrets for secret", "secret", key)
+			continue
+		}
+		for _, dopplerSecret := range dopplerSecrets.Items {
+			namespacedName := types.NamespacedName{Namespace: dopplerSecret.Namespace, Name: dopplerSecret.Name}
+			if !seen[namespacedName] {
+				seen[namespacedName] = true
+				requests = append(requests, reconcile.Request{NamespacedName: namespacedName})
+			}
+		}
+	}
+	return requests
+}
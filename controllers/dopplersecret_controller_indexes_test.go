@@ -0,0 +1,399 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unable to add client-go types to scheme: %v", err)
+	}
+	if err := secretsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatalf("unable to add DopplerSecret types to scheme: %v", err)
+	}
+	return scheme
+}
+
+func newTestDopplerSecret(namespace string, name string, managedSecretNamespace string, managedSecretName string) *secretsv1alpha1.DopplerSecret {
+	return &secretsv1alpha1.DopplerSecret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: secretsv1alpha1.DopplerSecretSpec{
+			ManagedSecretRef: secretsv1alpha1.ManagedSecretReference{Namespace: managedSecretNamespace, Name: managedSecretName},
+		},
+	}
+}
+
+func getRequestNames(requests []reconcile.Request) []string {
+	names := []string{}
+	for _, request := range requests {
+		names = append(names, request.NamespacedName.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns a fake client builder with the field indexes registered by setupIndexes
+func newTestIndexedClientBuilder(t *testing.T) *fake.ClientBuilder {
+	t.Helper()
+	return newTestWorkloadClientBuilder(t).
+		WithIndex(&secretsv1alpha1.DopplerSecret{}, dopplerSecretManagedSecretIndexField, indexDopplerSecretByManagedSecret).
+		WithIndex(&secretsv1alpha1.DopplerSecret{}, dopplerSecretReloadTargetIndexField, indexDopplerSecretByReloadTargets).
+		WithIndex(&secretsv1alpha1.DopplerSecret{}, dopplerSecretTokenSecretIndexField, indexDopplerSecretByTokenSecret)
+}
+
+func withTestTokenSecret(dopplerSecret *secretsv1alpha1.DopplerSecret, namespace string, name string) *secretsv1alpha1.DopplerSecret {
+	dopplerSecret.Spec.TokenSecretRef = secretsv1alpha1.TokenSecretReference{Namespace: namespace, Name: name}
+	return dopplerSecret
+}
+
+func withTestReloadTargets(dopplerSecret *secretsv1alpha1.DopplerSecret, targets ...secretsv1alpha1.ReloadTarget) *secretsv1alpha1.DopplerSecret {
+	dopplerSecret.Spec.Reload.Targets = targets
+	return dopplerSecret
+}
+
+func TestDopplerSecretIndexes(t *testing.T) {
+	tests := []struct {
+		name          string
+		dopplerSecret *secretsv1alpha1.DopplerSecret
+		managedSecret []string
+		reloadTargets []string
+		tokenSecret   []string
+	}{
+		{
+			name:          "references default to the DopplerSecret's namespace",
+			dopplerSecret: withTestTokenSecret(newTestDopplerSecret("default", "app", "", "app-secret"), "", "doppler-token"),
+			managedSecret: []string{"default/app-secret"},
+			reloadTargets: []string{},
+			tokenSecret:   []string{"default/doppler-token"},
+		},
+		{
+			name: "references in other namespaces",
+			dopplerSecret: withTestReloadTargets(
+				withTestTokenSecret(newTestDopplerSecret("doppler-operator-system", "app", "production", "app-secret"), "tokens", "doppler-token"),
+				secretsv1alpha1.ReloadTarget{Kind: "Deployment", Name: "web"},
+				secretsv1alpha1.ReloadTarget{Kind: "StatefulSet", Name: "db"},
+			),
+			managedSecret: []string{"production/app-secret"},
+			// Reload targets are in the managed secret's namespace
+			reloadTargets: []string{"production/Deployment/web", "production/StatefulSet/db"},
+			tokenSecret:   []string{"tokens/doppler-token"},
+		},
+		{
+			name:          "without a token secret",
+			dopplerSecret: newTestDopplerSecret("default", "app", "", "app-secret"),
+			managedSecret: []string{"default/app-secret"},
+			reloadTargets: []string{},
+			tokenSecret:   nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := indexDopplerSecretByManagedSecret(test.dopplerSecret); !reflect.DeepEqual(actual, test.managedSecret) {
+				t.Errorf("expected managed secret keys %v, got %v", test.managedSecret, actual)
+			}
+			if actual := indexDopplerSecretByReloadTargets(test.dopplerSecret); !reflect.DeepEqual(actual, test.reloadTargets) {
+				t.Errorf("expected reload target keys %v, got %v", test.reloadTargets, actual)
+			}
+			if actual := indexDopplerSecretByTokenSecret(test.dopplerSecret); !reflect.DeepEqual(actual, test.tokenSecret) {
+				t.Errorf("expected token secret keys %v, got %v", test.tokenSecret, actual)
+			}
+		})
+	}
+}
+
+func TestIndexWorkloadBySecretNames(t *testing.T) {
+	kind := findWorkloadKind(t, DefaultWorkloadKinds, "Deployment")
+	deployment := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{
+			Name:    "app",
+			EnvFrom: []corev1.EnvFromSource{secretEnvFrom("env-secret")},
+			Env:     []corev1.EnvVar{secretKeyRefEnv("key-secret", "API_KEY")},
+		}},
+		Volumes: []corev1.Volume{{Name: "config", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "volume-secret"}}}},
+	}}}}
+
+	actual := indexWorkloadBySecretNames(kind)(deployment)
+	sort.Strings(actual)
+	expected := []string{"env-secret", "key-secret", "volume-secret"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	if actual := indexWorkloadBySecretNames(kind)(&appsv1.StatefulSet{}); actual != nil {
+		t.Errorf("expected objects of another kind not to be indexed, got %v", actual)
+	}
+}
+
+func TestMapSecretToDopplerSecrets(t *testing.T) {
+	fakeClient := newTestIndexedClientBuilder(t).
+		WithObjects(
+			withTestTokenSecret(newTestDopplerSecret("default", "app", "", "app-secret"), "", "doppler-token"),
+			newTestDopplerSecret("doppler-operator-system", "app-remote", "default", "app-secret"),
+			withTestTokenSecret(newTestDopplerSecret("default", "other", "", "other-secret"), "", "doppler-token"),
+			withTestTokenSecret(newTestDopplerSecret("production", "remote-token", "", "remote-secret"), "default", "doppler-token"),
+			withTestTokenSecret(newTestDopplerSecret("default", "self", "", "self-secret"), "", "self-secret"),
+		).
+		Build()
+	r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard()}
+
+	tests := []struct {
+		name     string
+		secret   types.NamespacedName
+		expected []string
+	}{
+		{
+			name:     "managed secret in the DopplerSecret's namespace and in another namespace",
+			secret:   types.NamespacedName{Namespace: "default", Name: "app-secret"},
+			expected: []string{"default/app", "doppler-operator-system/app-remote"},
+		},
+		{
+			name:     "single DopplerSecret",
+			secret:   types.NamespacedName{Namespace: "default", Name: "other-secret"},
+			expected: []string{"default/other"},
+		},
+		{
+			name:     "secret with the same name in another namespace",
+			secret:   types.NamespacedName{Namespace: "doppler-operator-system", Name: "app-secret"},
+			expected: []string{},
+		},
+		{
+			name:     "token secret shared by DopplerSecrets in its namespace and in another namespace",
+			secret:   types.NamespacedName{Namespace: "default", Name: "doppler-token"},
+			expected: []string{"default/app", "default/other", "production/remote-token"},
+		},
+		{
+			name:     "secret which is both the managed secret and the token secret is only enqueued once",
+			secret:   types.NamespacedName{Namespace: "default", Name: "self-secret"},
+			expected: []string{"default/self"},
+		},
+		{
+			name:     "unrelated secret",
+			secret:   types.NamespacedName{Namespace: "default", Name: "unrelated"},
+			expected: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: test.secret.Namespace, Name: test.secret.Name}}
+			actual := getRequestNames(r.mapSecretToDopplerSecrets(context.Background(), secret))
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMapWorkloadToDopplerSecrets(t *testing.T) {
+	podTemplate := func(secretName string) corev1.PodTemplateSpec {
+		return corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", EnvFrom: []corev1.EnvFromSource{secretEnvFrom(secretName)}}}}}
+	}
+	fakeClient := newTestIndexedClientBuilder(t).
+		WithObjects(
+			newTestDopplerSecret("default", "app", "", "app-secret"),
+			newTestDopplerSecret("doppler-operator-system", "app-remote", "default", "app-secret"),
+			withTestReloadTargets(newTestDopplerSecret("default", "targets", "", "targets-secret"),
+				secretsv1alpha1.ReloadTarget{Kind: "Deployment", Name: "web"},
+				secretsv1alpha1.ReloadTarget{Kind: "Deployment", Name: "uses-app-secret"},
+			),
+			withTestReloadTargets(newTestDopplerSecret("doppler-operator-system", "targets-remote", "production", "targets-secret"),
+				secretsv1alpha1.ReloadTarget{Kind: "Deployment", Name: "web"},
+			),
+		).
+		Build()
+	r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard()}
+	deploymentKind := findWorkloadKind(t, DefaultWorkloadKinds, "Deployment")
+	statefulSetKind := findWorkloadKind(t, DefaultWorkloadKinds, "StatefulSet")
+	replicaSetKind := findWorkloadKind(t, DefaultWorkloadKinds, "ReplicaSet")
+
+	tests := []struct {
+		name     string
+		kind     *WorkloadKind
+		workload client.Object
+		expected []string
+	}{
+		{
+			name: "workload using a managed secret",
+			kind: deploymentKind,
+			workload: &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "api"},
+				Spec:       appsv1.DeploymentSpec{Template: podTemplate("app-secret")},
+			},
+			expected: []string{"default/app", "doppler-operator-system/app-remote"},
+		},
+		{
+			name:     "reload target",
+			kind:     deploymentKind,
+			workload: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}},
+			expected: []string{"default/targets"},
+		},
+		{
+			name:     "reload target in the managed secret's namespace",
+			kind:     deploymentKind,
+			workload: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "production", Name: "web"}},
+			expected: []string{"doppler-operator-system/targets-remote"},
+		},
+		{
+			name: "reload target which also uses a managed secret",
+			kind: deploymentKind,
+			workload: &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "uses-app-secret"},
+				Spec:       appsv1.DeploymentSpec{Template: podTemplate("app-secret")},
+			},
+			expected: []string{"default/app", "default/targets", "doppler-operator-system/app-remote"},
+		},
+		{
+			name:     "workload of another kind with a reload target's name",
+			kind:     statefulSetKind,
+			workload: &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}},
+			expected: []string{},
+		},
+		{
+			name: "workload using a managed secret with the same name in another namespace",
+			kind: deploymentKind,
+			workload: &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "production", Name: "api"},
+				Spec:       appsv1.DeploymentSpec{Template: podTemplate("app-secret")},
+			},
+			expected: []string{},
+		},
+		{
+			name: "ReplicaSet controlled by a Deployment",
+			kind: replicaSetKind,
+			workload: &appsv1.ReplicaSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:       "default",
+					Name:            "api-1",
+					OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "api", Controller: boolPtr(true)}},
+				},
+				Spec: appsv1.ReplicaSetSpec{Template: podTemplate("app-secret")},
+			},
+			expected: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := getRequestNames(r.mapWorkloadToDopplerSecrets(test.kind)(context.Background(), test.workload))
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+// Returns the requests enqueued by a watch's handler for an event which passes its predicate
+func getWatchRequestNames(t *testing.T, eventHandler handler.EventHandler, filter predicate.Predicate, evt interface{}) []string {
+	t.Helper()
+	queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]())
+	defer queue.ShutDown()
+	ctx := context.Background()
+	switch evt := evt.(type) {
+	case event.CreateEvent:
+		if filter.Create(evt) {
+			eventHandler.Create(ctx, evt, queue)
+		}
+	case event.UpdateEvent:
+		if filter.Update(evt) {
+			eventHandler.Update(ctx, evt, queue)
+		}
+	case event.DeleteEvent:
+		if filter.Delete(evt) {
+			eventHandler.Delete(ctx, evt, queue)
+		}
+	default:
+		t.Fatalf("unexpected event type %T", evt)
+	}
+	requests := []reconcile.Request{}
+	for queue.Len() > 0 {
+		request, _ := queue.Get()
+		requests = append(requests, request)
+		queue.Done(request)
+	}
+	return getRequestNames(requests)
+}
+
+func TestWorkloadWatch(t *testing.T) {
+	fakeClient := newTestIndexedClientBuilder(t).
+		WithObjects(newTestDopplerSecret("default", "app", "", "app-secret")).
+		Build()
+	r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard()}
+	eventHandler := handler.EnqueueRequestsFromMapFunc(r.mapWorkloadToDopplerSecrets(findWorkloadKind(t, DefaultWorkloadKinds, "Deployment")))
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "api", Generation: 1},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", EnvFrom: []corev1.EnvFromSource{secretEnvFrom("app-secret")}}},
+		}}},
+	}
+	statusUpdated := deployment.DeepCopy()
+	statusUpdated.Status.ReadyReplicas = 1
+	specUpdated := deployment.DeepCopy()
+	specUpdated.Generation = 2
+	annotated := deployment.DeepCopy()
+	annotated.Annotations = map[string]string{workloadRestartStrategyAnnotation: string(RestartStrategyEvict)}
+	// Removing the managed secret from the pod template still enqueues the DopplerSecret, through the old object
+	secretRemoved := deployment.DeepCopy()
+	secretRemoved.Generation = 2
+	secretRemoved.Spec.Template.Spec.Containers[0].EnvFrom = nil
+
+	tests := []struct {
+		name     string
+		event    interface{}
+		expected []string
+	}{
+		{name: "created", event: event.CreateEvent{Object: deployment}, expected: []string{"default/app"}},
+		{name: "deleted", event: event.DeleteEvent{Object: deployment}, expected: []string{"default/app"}},
+		{name: "spec updated", event: event.UpdateEvent{ObjectOld: deployment, ObjectNew: specUpdated}, expected: []string{"default/app"}},
+		{name: "annotations updated", event: event.UpdateEvent{ObjectOld: deployment, ObjectNew: annotated}, expected: []string{"default/app"}},
+		{name: "secret removed", event: event.UpdateEvent{ObjectOld: deployment, ObjectNew: secretRemoved}, expected: []string{"default/app"}},
+		{name: "status updated", event: event.UpdateEvent{ObjectOld: deployment, ObjectNew: statusUpdated}, expected: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := getWatchRequestNames(t, eventHandler, workloadChangedPredicate(), test.event)
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
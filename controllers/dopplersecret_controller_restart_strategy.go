@@ -0,0 +1,177 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+// RestartStrategy is how the operator restarts a workload when the secrets it uses change
+type RestartStrategy string
+
+const (
+	// Sets a secret version annotation on the pod template
+	RestartStrategyAnnotation RestartStrategy = "annotation"
+	// Sets the pod template annotation used by `kubectl rollout restart`
+	RestartStrategyRestartedAt RestartStrategy = "restartedAt"
+	// Evicts the workload's pods through the Eviction API, respecting PodDisruptionBudgets
+	RestartStrategyEvict RestartStrategy = "evict"
+)
+
+const (
+	workloadRestartStrategyAnnotation = "secrets.doppler.com/restart-strategy"
+	kubectlRestartedAtAnnotation      = "kubectl.kubernetes.io/restartedAt"
+
+	// The most controllers followed from a pod to its workload, e.g. Pod -> ReplicaSet -> Deployment
+	maxPodControllerDepth = 4
+)
+
+func parseRestartStrategy(value string) (RestartStrategy, error) {
+	switch strategy := RestartStrategy(value); strategy {
+	case RestartStrategyAnnotation, RestartStrategyRestartedAt, RestartStrategyEvict:
+		return strategy, nil
+	case "":
+		return RestartStrategyAnnotation, nil
+	default:
+		return "", fmt.Errorf("Unknown restart strategy %q, must be one of %s, %s or %s", value, RestartStrategyAnnotation, RestartStrategyRestartedAt, RestartStrategyEvict)
+	}
+}
+
+// Determines the restart strategy for a workload. Kinds which only support one strategy always use it.
+// Otherwise, the workload's restart strategy annotation takes precedence over the DopplerSecret's reload spec.
+func (r *DopplerSecretReconciler) getWorkloadRestartStrategy(workload Workload, dopplerSecret secretsv1alpha1.DopplerSecret) RestartStrategy {
+	if workload.Kind.RequiredRestartStrategy != "" {
+		return workload.Kind.RequiredRestartStrategy
+	}
+	if value, ok := workload.Object.GetAnnotations()[workloadRestartStrategyAnnotation]; ok {
+		strategy, err := parseRestartStrategy(value)
+		if err == nil {
+			return strategy
+		}
+		r.Log.Error(err, "Invalid workload restart strategy annotation, using the DopplerSecret's strategy", "workload", workload.String())
+	}
+	strategy, err := parseRestartStrategy(dopplerSecret.Spec.Reload.Strategy)
+	if err != nil {
+		// The CRD validates the strategy so this shouldn't happen
+		return RestartStrategyAnnotation
+	}
+	return strategy
+}
+
+// Evicts the pods of a workload which were created before the given time. Pods created since then already use the latest secrets.
+// Returns an error if any pod can't be evicted, e.g. because it would violate a PodDisruptionBudget. Remaining pods are evicted on the next attempt.
+func (r *DopplerSecretReconciler) evictWorkloadPods(ctx context.Context, workload Workload, createdBefore time.Time) error {
+	log := r.Log.WithValues("workload", workload.String())
+	selector, err := workload.Kind.GetSelector(workload.Object)
+	if err != nil {
+		return fmt.Errorf("Unable to read workload pod selector: %w", err)
+	}
+	// An empty selector matches every pod in the namespace
+	if selector == nil || (len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0) {
+		return fmt.Errorf("Unable to find pods to evict, the workload has no pod selector")
+	}
+	podSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return fmt.Errorf("Invalid workload pod selector: %w", err)
+	}
+	pods := &corev1.PodList{}
+	err = r.Client.List(ctx, pods, client.InNamespace(workload.Object.GetNamespace()), client.MatchingLabelsSelector{Selector: podSelector})
+	if err != nil {
+		return fmt.Errorf("Unable to list workload pods: %w", err)
+	}
+	numEvicted := 0
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || !pod.CreationTimestamp.Time.Before(createdBefore) {
+			continue
+		}
+		// Other controllers' pods can match the selector too
+		controlled, err := r.isPodControlledByWorkload(ctx, pod, workload)
+		if err != nil {
+			return err
+		}
+		if !controlled {
+			continue
+		}
+		eviction := &policyv1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+			},
+		}
+		err = r.Client.SubResource("eviction").Create(ctx, pod, eviction)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if errors.IsTooManyRequests(err) {
+			log.Info("[-] Pod eviction blocked by PodDisruptionBudget, will retry", "pod", pod.Name, "numEvicted", numEvicted)
+			return fmt.Errorf("Eviction of pod %s blocked by PodDisruptionBudget: %w", pod.Name, err)
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to evict pod %s: %w", pod.Name, err)
+		}
+		numEvicted++
+	}
+	log.Info("[/] Evicted workload pods", "numEvicted", numEvicted)
+	return nil
+}
+
+// Evaluates whether the workload controls the pod, either directly or through the controllers between them, e.g. a Deployment's ReplicaSet.
+// Only controllers of a configured workload kind are followed.
+func (r *DopplerSecretReconciler) isPodControlledByWorkload(ctx context.Context, pod *corev1.Pod, workload Workload) (bool, error) {
+	kinds := r.getWorkloadKinds()
+	var obj client.Object = pod
+	// Bounds the walk in case of an ownership cycle
+	for depth := 0; depth < maxPodControllerDepth; depth++ {
+		controller := metav1.GetControllerOf(obj)
+		if controller == nil {
+			return false, nil
+		}
+		if controller.UID == workload.Object.GetUID() {
+			return true, nil
+		}
+		kind := findControllerWorkloadKind(*controller, kinds)
+		if kind == nil {
+			return false, nil
+		}
+		owner := kind.NewObject()
+		err := r.Client.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: controller.Name}, owner)
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("Unable to fetch controller %s %s of pod %s: %w", controller.Kind, controller.Name, pod.Name, err)
+		}
+		// The controller was replaced by another object with the same name
+		if owner.GetUID() != controller.UID {
+			return false, nil
+		}
+		obj = owner
+	}
+	return false, nil
+}
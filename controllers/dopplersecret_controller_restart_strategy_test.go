@@ -0,0 +1,243 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+func newTestControllerRef(obj client.Object, kind string, apiVersion string) metav1.OwnerReference {
+	return metav1.OwnerReference{APIVersion: apiVersion, Kind: kind, Name: obj.GetName(), UID: obj.GetUID(), Controller: boolPtr(true)}
+}
+
+func newTestPod(name string, labels map[string]string, createdAt time.Time, controller *metav1.OwnerReference) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:         "default",
+		Name:              name,
+		Labels:            labels,
+		CreationTimestamp: metav1.NewTime(createdAt),
+	}}
+	if controller != nil {
+		pod.OwnerReferences = []metav1.OwnerReference{*controller}
+	}
+	return pod
+}
+
+func listTestPodNames(t *testing.T, c client.Client) []string {
+	t.Helper()
+	pods := &corev1.PodList{}
+	if err := c.List(context.Background(), pods); err != nil {
+		t.Fatalf("unable to list pods: %v", err)
+	}
+	names := []string{}
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestEvictWorkloadPods(t *testing.T) {
+	secretUpdatedAt := time.Now().UTC().Truncate(time.Second)
+	before := secretUpdatedAt.Add(-time.Hour)
+	after := secretUpdatedAt.Add(time.Minute)
+	labels := map[string]string{"app": "web"}
+	selector := &metav1.LabelSelector{MatchLabels: labels}
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "deployment-web"},
+		Spec:       appsv1.DeploymentSpec{Selector: selector},
+	}
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "web-1",
+			UID:             "replicaset-web-1",
+			OwnerReferences: []metav1.OwnerReference{newTestControllerRef(deployment, "Deployment", "apps/v1")},
+		},
+		Spec: appsv1.ReplicaSetSpec{Selector: selector},
+	}
+	// Another Deployment whose pods have the same labels
+	otherDeployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-canary", UID: "deployment-web-canary"},
+		Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web", "track": "canary"}}},
+	}
+	otherReplicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "web-canary-1",
+			UID:             "replicaset-web-canary-1",
+			OwnerReferences: []metav1.OwnerReference{newTestControllerRef(otherDeployment, "Deployment", "apps/v1")},
+		},
+	}
+	replicaSetRef := newTestControllerRef(replicaSet, "ReplicaSet", "apps/v1")
+	otherReplicaSetRef := newTestControllerRef(otherReplicaSet, "ReplicaSet", "apps/v1")
+	// A ReplicaSet which was replaced by another object with the same name
+	staleReplicaSetRef := replicaSetRef
+	staleReplicaSetRef.UID = "replicaset-web-1-deleted"
+
+	fakeClient := newTestWorkloadClientBuilder(t).
+		WithObjects(
+			deployment, replicaSet, otherDeployment, otherReplicaSet,
+			newTestPod("web-1-old", labels, before, &replicaSetRef),
+			newTestPod("web-1-new", labels, after, &replicaSetRef),
+			newTestPod("web-canary-1-old", map[string]string{"app": "web", "track": "canary"}, before, &otherReplicaSetRef),
+			newTestPod("web-stale", labels, before, &staleReplicaSetRef),
+			newTestPod("web-unowned", labels, before, nil),
+			newTestPod("api-old", map[string]string{"app": "api"}, before, &replicaSetRef),
+		).
+		Build()
+	r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard()}
+
+	workload := Workload{Kind: findWorkloadKind(t, DefaultWorkloadKinds, "Deployment"), Object: deployment}
+	if err := r.evictWorkloadPods(context.Background(), workload, secretUpdatedAt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"api-old", "web-1-new", "web-canary-1-old", "web-stale", "web-unowned"}
+	if actual := listTestPodNames(t, fakeClient); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected only web-1-old to be evicted, remaining pods %v", actual)
+	}
+}
+
+func TestEvictWorkloadPodsOfReplicaSet(t *testing.T) {
+	secretUpdatedAt := time.Now().UTC().Truncate(time.Second)
+	labels := map[string]string{"app": "worker"}
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker", UID: "replicaset-worker"},
+		Spec:       appsv1.ReplicaSetSpec{Selector: &metav1.LabelSelector{MatchLabels: labels}},
+	}
+	replicaSetRef := newTestControllerRef(replicaSet, "ReplicaSet", "apps/v1")
+	fakeClient := newTestWorkloadClientBuilder(t).
+		WithObjects(
+			replicaSet,
+			newTestPod("worker-old", labels, secretUpdatedAt.Add(-time.Hour), &replicaSetRef),
+			newTestPod("worker-lookalike", labels, secretUpdatedAt.Add(-time.Hour), nil),
+		).
+		Build()
+	r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard()}
+
+	workload := Workload{Kind: findWorkloadKind(t, DefaultWorkloadKinds, "ReplicaSet"), Object: replicaSet}
+	if err := r.evictWorkloadPods(context.Background(), workload, secretUpdatedAt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual := listTestPodNames(t, fakeClient); !reflect.DeepEqual(actual, []string{"worker-lookalike"}) {
+		t.Errorf("expected only worker-old to be evicted, remaining pods %v", actual)
+	}
+}
+
+func TestEvictWorkloadPodsWithoutSelector(t *testing.T) {
+	labels := map[string]string{"app": "web"}
+	tests := []struct {
+		name     string
+		selector *metav1.LabelSelector
+	}{
+		{name: "no selector"},
+		{name: "empty selector", selector: &metav1.LabelSelector{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "deployment-web"},
+				Spec:       appsv1.DeploymentSpec{Selector: test.selector},
+			}
+			deploymentRef := newTestControllerRef(deployment, "Deployment", "apps/v1")
+			fakeClient := newTestWorkloadClientBuilder(t).
+				WithObjects(deployment, newTestPod("web", labels, time.Now().Add(-time.Hour), &deploymentRef)).
+				Build()
+			r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard()}
+
+			workload := Workload{Kind: findWorkloadKind(t, DefaultWorkloadKinds, "Deployment"), Object: deployment}
+			if err := r.evictWorkloadPods(context.Background(), workload, time.Now()); err == nil {
+				t.Errorf("expected an error evicting the pods of a workload without a selector")
+			}
+			if actual := listTestPodNames(t, fakeClient); !reflect.DeepEqual(actual, []string{"web"}) {
+				t.Errorf("expected no pods to be evicted, remaining pods %v", actual)
+			}
+		})
+	}
+}
+
+func TestReconcileCronJobDoesNotEvictRunningJobs(t *testing.T) {
+	labels := map[string]string{"app": "report"}
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "report", UID: "cronjob-report"},
+		Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}},
+		}}},
+	}
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "default",
+		Name:            "report-1",
+		UID:             "job-report-1",
+		OwnerReferences: []metav1.OwnerReference{newTestControllerRef(cronJob, "CronJob", "batch/v1")},
+	}}
+	jobRef := newTestControllerRef(job, "Job", "batch/v1")
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        testSecretName,
+		Annotations: map[string]string{kubeSecretLastUpdatedAnnotation: time.Now().UTC().Format(time.RFC3339)},
+	}}
+	fakeClient := newTestWorkloadClientBuilder(t).
+		WithObjects(cronJob, job, secret, newTestPod("report-1-abc", labels, time.Now().Add(-time.Hour), &jobRef)).
+		Build()
+	r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard()}
+	dopplerSecret := secretsv1alpha1.DopplerSecret{Spec: secretsv1alpha1.DopplerSecretSpec{
+		Reload: secretsv1alpha1.ReloadSpec{Strategy: string(RestartStrategyEvict)},
+	}}
+
+	workload := Workload{Kind: findWorkloadKind(t, DefaultWorkloadKinds, "CronJob"), Object: cronJob}
+	strategy := r.getWorkloadRestartStrategy(workload, dopplerSecret)
+	if strategy != RestartStrategyAnnotation {
+		t.Fatalf("expected CronJobs to use the %s strategy, got %s", RestartStrategyAnnotation, strategy)
+	}
+	if err := r.ReconcileWorkload(context.Background(), workload, secret, "W/\"v2\"", strategy); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual := listTestPodNames(t, fakeClient); !reflect.DeepEqual(actual, []string{"report-1-abc"}) {
+		t.Errorf("expected the running job's pod to be left alone, remaining pods %v", actual)
+	}
+	updated := &batchv1.CronJob{}
+	if err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "report"}, updated); err != nil {
+		t.Fatalf("unable to fetch CronJob: %v", err)
+	}
+	if value := updated.Spec.JobTemplate.Spec.Template.Annotations[getWorkloadSecretUpdateAnnotation(testSecretName)]; value != "W/\"v2\"" {
+		t.Errorf("expected the job template to be annotated with the secrets version, got %q", value)
+	}
+
+	// Evicting a CronJob's pods directly is refused as it doesn't select pods itself
+	if err := r.evictWorkloadPods(context.Background(), workload, time.Now()); err == nil {
+		t.Errorf("expected an error evicting the pods of a CronJob")
+	}
+	if actual := listTestPodNames(t, fakeClient); !reflect.DeepEqual(actual, []string{"report-1-abc"}) {
+		t.Errorf("expected the running job's pod to be left alone, remaining pods %v", actual)
+	}
+}
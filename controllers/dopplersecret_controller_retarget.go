@@ -0,0 +1,94 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+// ReconcileManagedSecretTarget records the managed secret synced by the DopplerSecret in its status. If the managed secret reference
+// has changed since the last sync, the deletion policy is applied to the previous secret and workloads still using it are reported.
+// Should only be called once the new managed secret has been synced.
+func (r *DopplerSecretReconciler) ReconcileManagedSecretTarget(ctx context.Context, dopplerSecret *secretsv1alpha1.DopplerSecret) error {
+	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName())
+	current := getManagedSecretNamespacedName(*dopplerSecret)
+	applied := dopplerSecret.Status.ManagedSecret
+	if applied != nil && applied.Name == current.Name && applied.Namespace == current.Namespace {
+		return nil
+	}
+
+	if applied != nil {
+		previous := types.NamespacedName{Namespace: applied.Namespace, Name: applied.Name}
+		workloads, err := r.ListWorkloadsUsingSecret(ctx, previous)
+		if err != nil {
+			return err
+		}
+		workloadNames := []string{}
+		for _, workload := range workloads {
+			workloadNames = append(workloadNames, workload.String())
+		}
+
+		policy := getDeletionPolicy(*dopplerSecret)
+		if policy == DeletionPolicyDelete && len(workloads) > 0 {
+			// Deleting the secret would prevent these workloads' pods from starting, so only label it for cleanup
+			policy = DeletionPolicyOrphan
+		}
+		message, err := r.ApplyDeletionPolicy(ctx, *dopplerSecret, previous, policy)
+		if err != nil {
+			return err
+		}
+		log.Info("[/] Managed secret reference changed", "previous", previous.String(), "current", current.String(), "policy", policy)
+		r.recordEvent(dopplerSecret, corev1.EventTypeNormal, eventReasonManagedSecretRetargeted, "Managed secret changed from %s to %s. %s", previous, current, message)
+
+		condition := metav1.Condition{
+			Type:    "secrets.doppler.com/ManagedSecretRetargeted",
+			Status:  metav1.ConditionTrue,
+			Reason:  "Retargeted",
+			Message: fmt.Sprintf("Managed secret changed from %s to %s. %s", previous, current, message),
+		}
+		if len(workloads) > 0 {
+			log.Info("[-] Workloads are still using the previous managed secret", "previous", previous.String(), "workloads", workloadNames)
+			r.recordEvent(dopplerSecret, corev1.EventTypeWarning, eventReasonPreviousSecretInUse, "Workloads are still using the previous managed secret %s: %s", previous, strings.Join(workloadNames, ", "))
+			condition.Reason = "PreviousSecretInUse"
+			condition.Message = fmt.Sprintf("%s Workloads still using %s: %s", condition.Message, previous, strings.Join(workloadNames, ", "))
+		}
+		if dopplerSecret.Status.Conditions == nil {
+			dopplerSecret.Status.Conditions = []metav1.Condition{}
+		}
+		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, condition)
+		// A rollback of the previous secret doesn't apply to the new one
+		dopplerSecret.Status.Rollback = nil
+	}
+
+	dopplerSecret.Status.ManagedSecret = &secretsv1alpha1.ManagedSecretStatus{
+		Name:      current.Name,
+		Namespace: current.Namespace,
+	}
+	if err := r.Client.Status().Update(ctx, dopplerSecret); err != nil {
+		return fmt.Errorf("Unable to record managed secret in status: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+// Returns the reasons of the events recorded so far
+func getRecordedEventReasons(recorder *record.FakeRecorder) []string {
+	reasons := []string{}
+	for len(recorder.Events) > 0 {
+		reasons = append(reasons, strings.Fields(<-recorder.Events)[1])
+	}
+	return reasons
+}
+
+func TestReconcileManagedSecretTargetRecordsManagedSecret(t *testing.T) {
+	ctx := context.Background()
+	dopplerSecret := newTestDopplerSecret("default", "app", "", "app-secret")
+	fakeClient := newTestWorkloadClientBuilder(t).
+		WithObjects(dopplerSecret).
+		WithStatusSubresource(&secretsv1alpha1.DopplerSecret{}).
+		Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard(), Recorder: recorder}
+
+	if err := r.ReconcileManagedSecretTarget(ctx, dopplerSecret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored := &secretsv1alpha1.DopplerSecret{}
+	if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(dopplerSecret), stored); err != nil {
+		t.Fatalf("unable to fetch DopplerSecret: %v", err)
+	}
+	expected := &secretsv1alpha1.ManagedSecretStatus{Name: "app-secret", Namespace: "default"}
+	if !reflect.DeepEqual(stored.Status.ManagedSecret, expected) {
+		t.Errorf("expected status.managedSecret %+v, got %+v", expected, stored.Status.ManagedSecret)
+	}
+	if meta.FindStatusCondition(stored.Status.Conditions, "secrets.doppler.com/ManagedSecretRetargeted") != nil {
+		t.Errorf("expected no retargeted condition on the first sync")
+	}
+
+	// Reconciling the same target again changes nothing
+	resourceVersion := stored.ResourceVersion
+	if err := r.ReconcileManagedSecretTarget(ctx, stored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(dopplerSecret), stored); err != nil {
+		t.Fatalf("unable to fetch DopplerSecret: %v", err)
+	}
+	if stored.ResourceVersion != resourceVersion {
+		t.Errorf("expected the DopplerSecret not to be updated when the target is unchanged")
+	}
+	if reasons := getRecordedEventReasons(recorder); len(reasons) != 0 {
+		t.Errorf("expected no events, got %v", reasons)
+	}
+}
+
+func TestReconcileManagedSecretTargetAppliesPolicyToPreviousTarget(t *testing.T) {
+	tests := []struct {
+		name            string
+		policy          DeletionPolicy
+		workloadUsesOld bool
+		oldDeleted      bool
+		oldOrphaned     bool
+		reason          string
+		events          []string
+	}{
+		{
+			name:   "retain",
+			policy: DeletionPolicyRetain,
+			reason: "Retargeted",
+			events: []string{eventReasonManagedSecretRetargeted},
+		},
+		{
+			name:       "delete",
+			policy:     DeletionPolicyDelete,
+			oldDeleted: true,
+			reason:     "Retargeted",
+			events:     []string{eventReasonManagedSecretRetargeted},
+		},
+		{
+			name:        "orphan",
+			policy:      DeletionPolicyOrphan,
+			oldOrphaned: true,
+			reason:      "Retargeted",
+			events:      []string{eventReasonManagedSecretRetargeted},
+		},
+		{
+			name:            "delete is downgraded to orphan while workloads use the previous secret",
+			policy:          DeletionPolicyDelete,
+			workloadUsesOld: true,
+			oldOrphaned:     true,
+			reason:          "PreviousSecretInUse",
+			events:          []string{eventReasonManagedSecretRetargeted, eventReasonPreviousSecretInUse},
+		},
+		{
+			name:            "retain while workloads use the previous secret",
+			policy:          DeletionPolicyRetain,
+			workloadUsesOld: true,
+			reason:          "PreviousSecretInUse",
+			events:          []string{eventReasonManagedSecretRetargeted, eventReasonPreviousSecretInUse},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			dopplerSecret := newTestDopplerSecret("default", "app", "", "new-secret")
+			dopplerSecret.Spec.ManagedSecretRef.DeletionPolicy = string(test.policy)
+			dopplerSecret.Status.ManagedSecret = &secretsv1alpha1.ManagedSecretStatus{Name: "old-secret", Namespace: "default"}
+			dopplerSecret.Status.Rollback = &secretsv1alpha1.RollbackStatus{FailedVersion: "v2", RestoredVersion: "v1"}
+			objects := []client.Object{
+				dopplerSecret,
+				newTestOperatorSecret("old-secret", "default/app", "dopplerSecret"),
+				newTestOperatorSecret("new-secret", "default/app", "dopplerSecret"),
+			}
+			if test.workloadUsesOld {
+				objects = append(objects, &appsv1.Deployment{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "api"},
+					Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Name: "app", EnvFrom: []corev1.EnvFromSource{secretEnvFrom("old-secret")}}},
+					}}},
+				})
+			}
+			fakeClient := newTestWorkloadClientBuilder(t).
+				WithObjects(objects...).
+				WithStatusSubresource(&secretsv1alpha1.DopplerSecret{}).
+				Build()
+			recorder := record.NewFakeRecorder(10)
+			r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard(), Recorder: recorder}
+
+			if err := r.ReconcileManagedSecretTarget(ctx, dopplerSecret); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			oldSecret := getTestSecretIfExists(t, fakeClient, "old-secret")
+			if (oldSecret == nil) != test.oldDeleted {
+				t.Errorf("expected the previous target deleted to be %t", test.oldDeleted)
+			}
+			if oldSecret != nil {
+				if _, orphaned := oldSecret.Labels[kubeSecretOrphanedLabel]; orphaned != test.oldOrphaned {
+					t.Errorf("expected the previous target orphaned to be %t, got labels %v", test.oldOrphaned, oldSecret.Labels)
+				}
+			}
+			if getTestSecretIfExists(t, fakeClient, "new-secret") == nil {
+				t.Errorf("expected the new target to be left in place")
+			}
+
+			stored := &secretsv1alpha1.DopplerSecret{}
+			if err := fakeClient.Get(ctx, client.ObjectKeyFromObject(dopplerSecret), stored); err != nil {
+				t.Fatalf("unable to fetch DopplerSecret: %v", err)
+			}
+			expected := &secretsv1alpha1.ManagedSecretStatus{Name: "new-secret", Namespace: "default"}
+			if !reflect.DeepEqual(stored.Status.ManagedSecret, expected) {
+				t.Errorf("expected status.managedSecret %+v, got %+v", expected, stored.Status.ManagedSecret)
+			}
+			if stored.Status.Rollback != nil {
+				t.Errorf("expected the rollback of the previous target to be cleared, got %+v", stored.Status.Rollback)
+			}
+			condition := meta.FindStatusCondition(stored.Status.Conditions, "secrets.doppler.com/ManagedSecretRetargeted")
+			if condition == nil || condition.Reason != test.reason {
+				t.Fatalf("expected a retargeted condition with reason %s, got %+v", test.reason, condition)
+			}
+			if test.workloadUsesOld && !strings.Contains(condition.Message, "Deployment default/api") {
+				t.Errorf("expected the condition to list the workloads using the previous target, got %q", condition.Message)
+			}
+			if reasons := getRecordedEventReasons(recorder); !reflect.DeepEqual(reasons, test.events) {
+				t.Errorf("expected events %v, got %v", test.events, reasons)
+			}
+		})
+	}
+}
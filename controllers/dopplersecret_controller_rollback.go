@@ -0,0 +1,256 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+	"github.com/DopplerHQ/kubernetes-operator/pkg/models"
+)
+
+const (
+	previousSecretNameSuffix = "-doppler-previous"
+	previousSecretSubtype    = "dopplerSecretPrevious"
+)
+
+// GetPreviousSecretName returns the name of the secret holding the previous payload of a managed secret
+func GetPreviousSecretName(managedSecretName string) string {
+	return managedSecretName + previousSecretNameSuffix
+}
+
+// SavePreviousSecret copies the current payload of a managed secret to its previous secret so it can be restored
+// if the new payload causes workload rollouts to fail. Only the keys written by the operator are copied.
+// Fails with an OwnershipConflictError if the previous secret already exists but isn't managed by the DopplerSecret.
+func (r *DopplerSecretReconciler) SavePreviousSecret(ctx context.Context, managedSecret corev1.Secret, dopplerSecret secretsv1alpha1.DopplerSecret) error {
+	previousSecretNamespacedName := types.NamespacedName{
+		Name:      GetPreviousSecretName(managedSecret.Name),
+		Namespace: managedSecret.Namespace,
+	}
+	data := map[string][]byte{}
+	for k := range getPreviousManagedSecretKeys(managedSecret) {
+		if v, ok := managedSecret.Data[k]; ok {
+			data[k] = v
+		}
+	}
+	annotations := map[string]string{
+		kubeSecretManagedByAnnotation: dopplerSecret.GetNamespacedName(),
+		kubeSecretVersionAnnotation:   managedSecret.Annotations[kubeSecretVersionAnnotation],
+	}
+	labels := map[string]string{
+		kubeSecretSubtypeLabel: previousSecretSubtype,
+	}
+
+	previousSecret, err := r.GetReferencedSecret(ctx, previousSecretNamespacedName)
+	if errors.IsNotFound(err) {
+		previousSecret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        previousSecretNamespacedName.Name,
+				Namespace:   previousSecretNamespacedName.Namespace,
+				Annotations: annotations,
+				Labels:      labels,
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: data,
+		}
+		if err := r.Client.Create(ctx, previousSecret); err != nil {
+			return fmt.Errorf("Failed to create previous secret: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to fetch previous secret: %w", err)
+	}
+	if !dopplerSecret.Spec.ManagedSecretRef.Adopt {
+		if err := checkManagedSecretOwnership(*previousSecret, dopplerSecret); err != nil {
+			return err
+		}
+	}
+	previousSecret.Annotations = annotations
+	previousSecret.Labels = labels
+	previousSecret.Data = data
+	if err := r.Client.Update(ctx, previousSecret); err != nil {
+		return fmt.Errorf("Failed to update previous secret: %w", err)
+	}
+	return nil
+}
+
+// DeletePreviousSecret deletes the previous secret of a managed secret, unless it doesn't exist or isn't managed by the DopplerSecret
+func (r *DopplerSecretReconciler) DeletePreviousSecret(ctx context.Context, managedSecret corev1.Secret, dopplerSecret secretsv1alpha1.DopplerSecret) error {
+	previousSecret, err := r.GetReferencedSecret(ctx, types.NamespacedName{
+		Name:      GetPreviousSecretName(managedSecret.Name),
+		Namespace: managedSecret.Namespace,
+	})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to fetch previous secret: %w", err)
+	}
+	if checkManagedSecretOwnership(*previousSecret, dopplerSecret) != nil {
+		return nil
+	}
+	if err := r.Client.Delete(ctx, previousSecret, client.Preconditions{UID: &previousSecret.UID}); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("Unable to delete previous secret: %w", err)
+	}
+	r.Log.Info("[/] Deleted previous secret", "dopplersecret", dopplerSecret.GetNamespacedName(), "secret", client.ObjectKeyFromObject(previousSecret))
+	return nil
+}
+
+// ReconcileRollback restores the previous payload of the managed secret when a workload restarted for the current payload fails to roll out.
+// Once rolled back, syncing is held (see UpdateSecret) until the Doppler secrets change from the failed version.
+// Returns true if the managed secret was rolled back.
+func (r *DopplerSecretReconciler) ReconcileRollback(ctx context.Context, dopplerSecret *secretsv1alpha1.DopplerSecret, reloadResult WorkloadReloadResult) (bool, error) {
+	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName())
+	managedSecretNamespace := dopplerSecret.Spec.ManagedSecretRef.Namespace
+	if managedSecretNamespace == "" {
+		managedSecretNamespace = dopplerSecret.Namespace
+	}
+	managedSecret, err := r.GetReferencedSecret(ctx, types.NamespacedName{
+		Name:      dopplerSecret.Spec.ManagedSecretRef.Name,
+		Namespace: managedSecretNamespace,
+	})
+	if err != nil {
+		return false, fmt.Errorf("Unable to fetch managed secret: %w", err)
+	}
+	currentVersion := managedSecret.Annotations[kubeSecretVersionAnnotation]
+
+	if rollback := dopplerSecret.Status.Rollback; rollback != nil {
+		if currentVersion != rollback.RestoredVersion || !dopplerSecret.Spec.Reload.RollbackOnFailedRollout {
+			log.Info("[/] Managed secret has changed since rollback, resuming sync", "failedVersion", rollback.FailedVersion, "currentVersion", currentVersion)
+			dopplerSecret.Status.Rollback = nil
+			r.SetRollbackCondition(ctx, dopplerSecret)
+		}
+		if dopplerSecret.Spec.Reload.RollbackOnFailedRollout {
+			return false, nil
+		}
+	}
+
+	if !dopplerSecret.Spec.Reload.RollbackOnFailedRollout {
+		// The previous secret is only needed to roll back, so don't keep a copy of the secrets around once it's disabled
+		return false, r.DeletePreviousSecret(ctx, *managedSecret, *dopplerSecret)
+	}
+	if len(reloadResult.FailedWorkloads) == 0 {
+		return false, nil
+	}
+
+	previousSecret, err := r.GetReferencedSecret(ctx, types.NamespacedName{
+		Name:      GetPreviousSecretName(managedSecret.Name),
+		Namespace: managedSecret.Namespace,
+	})
+	if errors.IsNotFound(err) {
+		log.Info("[-] Workload rollouts failed but there is no previous secret to roll back to", "failedWorkloads", reloadResult.FailedWorkloads)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to fetch previous secret: %w", err)
+	}
+	previousVersion := previousSecret.Annotations[kubeSecretVersionAnnotation]
+	if previousVersion == currentVersion {
+		log.Info("[-] Workload rollouts failed but the previous secret is the current version", "failedWorkloads", reloadResult.FailedWorkloads)
+		return false, nil
+	}
+
+	if _, err := r.restorePreviousSecret(ctx, *dopplerSecret, managedSecret, previousSecret); err != nil {
+		return false, err
+	}
+	log.Info("[/] Rolled back managed secret after failed workload rollouts", "failedVersion", currentVersion, "restoredVersion", previousVersion, "failedWorkloads", reloadResult.FailedWorkloads)
+
+	dopplerSecret.Status.Rollback = &secretsv1alpha1.RollbackStatus{
+		FailedVersion:   currentVersion,
+		RestoredVersion: previousVersion,
+		FailedWorkloads: reloadResult.FailedWorkloads,
+		Time:            metav1.Now(),
+	}
+	r.SetRollbackCondition(ctx, dopplerSecret)
+	return true, nil
+}
+
+// Rebuilds the managed secret from the payload of the previous secret, with the labels and annotations currently configured on the DopplerSecret.
+// The payload was processed and formatted when it was saved, so the current processors and format are recorded but only take effect once syncing resumes.
+func (r *DopplerSecretReconciler) restorePreviousSecret(ctx context.Context, dopplerSecret secretsv1alpha1.DopplerSecret, managedSecret *corev1.Secret, previousSecret *corev1.Secret) (*corev1.Secret, error) {
+	salt, err := getKeyHashesSalt(managedSecret)
+	if err != nil {
+		return nil, err
+	}
+	keyHashes, err := GetKeyHashesAnnotation(previousSecret.Data, salt)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compute key hashes: %w", err)
+	}
+	processorsVersion, err := GetProcessorsVersion(dopplerSecret.Spec.Processors)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compute processors version: %w", err)
+	}
+	if err := r.upgradeManagedSecretFields(ctx, managedSecret); err != nil {
+		return nil, err
+	}
+	restoredVersion := models.SecretsResult{ETag: previousSecret.Annotations[kubeSecretVersionAnnotation]}
+	annotations := GetKubeSecretAnnotations(restoredVersion, processorsVersion, dopplerSecret.Spec.Format, dopplerSecret.Spec.ManagedSecretRef.Annotations, dopplerSecret.GetNamespacedName())
+	if dashboardLink, ok := managedSecret.Annotations[kubeSecretDashboardLinkAnnotaion]; ok {
+		annotations[kubeSecretDashboardLinkAnnotaion] = dashboardLink
+	}
+	annotations[kubeSecretKeyHashesAnnotation] = keyHashes
+	annotations[kubeSecretKeyHashesSaltAnnotation] = salt
+	restoredSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        managedSecret.Name,
+			Namespace:   managedSecret.Namespace,
+			Annotations: annotations,
+			Labels:      GetKubeSecretLabels(dopplerSecret.Spec.ManagedSecretRef.Labels, getDeletionPolicy(dopplerSecret)),
+		},
+		Type: managedSecret.Type,
+		Data: previousSecret.Data,
+	}
+	if err := r.applyManagedSecret(ctx, restoredSecret); err != nil {
+		return nil, fmt.Errorf("Failed to restore managed secret from previous secret: %w", err)
+	}
+	return restoredSecret, nil
+}
+
+func (r *DopplerSecretReconciler) SetRollbackCondition(ctx context.Context, dopplerSecret *secretsv1alpha1.DopplerSecret) {
+	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName())
+	if dopplerSecret.Status.Conditions == nil {
+		dopplerSecret.Status.Conditions = []metav1.Condition{}
+	}
+	if rollback := dopplerSecret.Status.Rollback; rollback != nil {
+		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
+			Type:    "secrets.doppler.com/SecretRolledBack",
+			Status:  metav1.ConditionTrue,
+			Reason:  "RolloutFailed",
+			Message: fmt.Sprintf("Managed secret was rolled back to %s after workload rollouts failed. Syncing is held until the Doppler secrets change.", rollback.RestoredVersion),
+		})
+	} else {
+		meta.SetStatusCondition(&dopplerSecret.Status.Conditions, metav1.Condition{
+			Type:    "secrets.doppler.com/SecretRolledBack",
+			Status:  metav1.ConditionFalse,
+			Reason:  "Resumed",
+			Message: "Managed secret is being synced from Doppler",
+		})
+	}
+	err := r.Client.Status().Update(ctx, dopplerSecret)
+	if err != nil {
+		log.Error(err, "Unable to set rollback condition")
+	}
+}
@@ -0,0 +1,536 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+	"github.com/DopplerHQ/kubernetes-operator/pkg/models"
+)
+
+// fakeDopplerAPI serves the secrets download endpoint with a single version of the secrets which can be changed by the test
+type fakeDopplerAPI struct {
+	mu      sync.Mutex
+	eTag    string
+	secrets map[string]string
+}
+
+func (f *fakeDopplerAPI) setSecrets(eTag string, secrets map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.eTag = eTag
+	f.secrets = secrets
+}
+
+func (f *fakeDopplerAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.URL.Path != "/v3/configs/config/secrets/download" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Header.Get("If-None-Match") == f.eTag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", f.eTag)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(f.secrets)
+}
+
+func secretsResultFor(eTag string, secrets map[string]string) models.SecretsResult {
+	result := models.SecretsResult{Modified: true, ETag: eTag}
+	for k, v := range secrets {
+		result.Secrets = append(result.Secrets, models.Secret{Name: k, Value: v})
+	}
+	return result
+}
+
+var _ = Describe("Rolling back failed rollouts", func() {
+	const salt = "test-salt"
+
+	var (
+		ctx           context.Context
+		r             *DopplerSecretReconciler
+		dopplerAPI    *fakeDopplerAPI
+		server        *httptest.Server
+		namespace     string
+		dopplerSecret *secretsv1alpha1.DopplerSecret
+	)
+
+	getSecret := func(name string) *corev1.Secret {
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, secret)).To(Succeed())
+		return secret
+	}
+
+	// Applies the managed secret at the given version, as the operator would after syncing it
+	applyManagedSecret := func(eTag string, secrets map[string]string) *corev1.Secret {
+		secret, err := BuildManagedSecret(*dopplerSecret, secretsResultFor(eTag, secrets), salt)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.applyManagedSecret(ctx, secret)).To(Succeed())
+		return getSecret("managed")
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		dopplerAPI = &fakeDopplerAPI{}
+		server = httptest.NewServer(dopplerAPI)
+		r = &DopplerSecretReconciler{
+			Client:   k8sClient,
+			Log:      GinkgoLogr,
+			Scheme:   scheme.Scheme,
+			Recorder: record.NewFakeRecorder(100),
+			Rollouts: NewRolloutOrchestrator(0),
+		}
+
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "rollback-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.Name
+
+		tokenSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "doppler-token", Namespace: namespace},
+			Data:       map[string][]byte{kubeSecretServiceTokenKey: []byte("dp.st.test")},
+		}
+		Expect(k8sClient.Create(ctx, tokenSecret)).To(Succeed())
+
+		dopplerSecret = &secretsv1alpha1.DopplerSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: "dopplersecret", Namespace: namespace},
+			Spec: secretsv1alpha1.DopplerSecretSpec{
+				TokenSecretRef:   secretsv1alpha1.TokenSecretReference{Name: "doppler-token"},
+				ManagedSecretRef: secretsv1alpha1.ManagedSecretReference{Name: "managed", Namespace: namespace, Type: string(corev1.SecretTypeOpaque)},
+				Host:             server.URL,
+				Reload:           secretsv1alpha1.ReloadSpec{RollbackOnFailedRollout: true},
+			},
+		}
+		Expect(k8sClient.Create(ctx, dopplerSecret)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("saves only the keys written by the operator", func() {
+		managedSecret := applyManagedSecret("v1", map[string]string{"API_KEY": "one", "DB_URL": "postgres://one"})
+		managedSecret.Data["ADDED_BY_OTHERS"] = []byte("other")
+		Expect(k8sClient.Update(ctx, managedSecret)).To(Succeed())
+
+		Expect(r.SavePreviousSecret(ctx, *getSecret("managed"), *dopplerSecret)).To(Succeed())
+
+		previousSecret := getSecret(GetPreviousSecretName("managed"))
+		Expect(previousSecret.Data).To(Equal(map[string][]byte{"API_KEY": []byte("one"), "DB_URL": []byte("postgres://one")}))
+		Expect(previousSecret.Annotations).To(HaveKeyWithValue(kubeSecretVersionAnnotation, "v1"))
+		Expect(previousSecret.Annotations).To(HaveKeyWithValue(kubeSecretManagedByAnnotation, dopplerSecret.GetNamespacedName()))
+		Expect(previousSecret.Labels).To(HaveKeyWithValue(kubeSecretSubtypeLabel, previousSecretSubtype))
+	})
+
+	It("doesn't overwrite a previous secret which isn't managed by the DopplerSecret", func() {
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: GetPreviousSecretName("managed"), Namespace: namespace},
+			Data:       map[string][]byte{"UNRELATED": []byte("keep")},
+		}
+		Expect(k8sClient.Create(ctx, existing)).To(Succeed())
+		managedSecret := applyManagedSecret("v1", map[string]string{"API_KEY": "one"})
+
+		err := r.SavePreviousSecret(ctx, *managedSecret, *dopplerSecret)
+		var ownershipConflict *OwnershipConflictError
+		Expect(errors.As(err, &ownershipConflict)).To(BeTrue())
+		Expect(getSecret(GetPreviousSecretName("managed")).Data).To(Equal(map[string][]byte{"UNRELATED": []byte("keep")}))
+	})
+
+	It("restores the previous secret when a workload fails to roll out", func() {
+		Expect(r.SavePreviousSecret(ctx, *applyManagedSecret("v1", map[string]string{"API_KEY": "one"}), *dopplerSecret)).To(Succeed())
+		applyManagedSecret("v2", map[string]string{"API_KEY": "two"})
+
+		rolledBack, err := r.ReconcileRollback(ctx, dopplerSecret, WorkloadReloadResult{FailedWorkloads: []string{"Deployment " + namespace + "/api"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledBack).To(BeTrue())
+
+		managedSecret := getSecret("managed")
+		Expect(managedSecret.Data).To(Equal(map[string][]byte{"API_KEY": []byte("one")}))
+		Expect(managedSecret.Annotations).To(HaveKeyWithValue(kubeSecretVersionAnnotation, "v1"))
+		keyHashes, err := GetKeyHashesAnnotation(managedSecret.Data, salt)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(managedSecret.Annotations).To(HaveKeyWithValue(kubeSecretKeyHashesAnnotation, keyHashes))
+
+		Expect(dopplerSecret.Status.Rollback).NotTo(BeNil())
+		Expect(dopplerSecret.Status.Rollback.FailedVersion).To(Equal("v2"))
+		Expect(dopplerSecret.Status.Rollback.RestoredVersion).To(Equal("v1"))
+		Expect(meta.IsStatusConditionTrue(dopplerSecret.Status.Conditions, "secrets.doppler.com/SecretRolledBack")).To(BeTrue())
+	})
+
+	It("holds the rolled back secret until the Doppler secrets change", func() {
+		Expect(r.SavePreviousSecret(ctx, *applyManagedSecret("v1", map[string]string{"API_KEY": "one"}), *dopplerSecret)).To(Succeed())
+		applyManagedSecret("v2", map[string]string{"API_KEY": "two"})
+		dopplerAPI.setSecrets("v2", map[string]string{"API_KEY": "two"})
+		rolledBack, err := r.ReconcileRollback(ctx, dopplerSecret, WorkloadReloadResult{FailedWorkloads: []string{"Deployment " + namespace + "/api"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledBack).To(BeTrue())
+
+		By("holding while Doppler still serves the failed version")
+		_, err = r.UpdateSecret(ctx, *dopplerSecret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(getSecret("managed").Data).To(Equal(map[string][]byte{"API_KEY": []byte("one")}))
+		rolledBack, err = r.ReconcileRollback(ctx, dopplerSecret, WorkloadReloadResult{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledBack).To(BeFalse())
+		Expect(dopplerSecret.Status.Rollback).NotTo(BeNil())
+
+		By("resuming once the Doppler secrets change")
+		dopplerAPI.setSecrets("v3", map[string]string{"API_KEY": "three"})
+		_, err = r.UpdateSecret(ctx, *dopplerSecret)
+		Expect(err).NotTo(HaveOccurred())
+		managedSecret := getSecret("managed")
+		Expect(managedSecret.Data).To(Equal(map[string][]byte{"API_KEY": []byte("three")}))
+		Expect(managedSecret.Annotations).To(HaveKeyWithValue(kubeSecretVersionAnnotation, "v3"))
+		Expect(getSecret(GetPreviousSecretName("managed")).Data).To(Equal(map[string][]byte{"API_KEY": []byte("one")}))
+
+		rolledBack, err = r.ReconcileRollback(ctx, dopplerSecret, WorkloadReloadResult{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledBack).To(BeFalse())
+		Expect(dopplerSecret.Status.Rollback).To(BeNil())
+		Expect(meta.IsStatusConditionFalse(dopplerSecret.Status.Conditions, "secrets.doppler.com/SecretRolledBack")).To(BeTrue())
+	})
+
+	It("holds the rolled back secret when the managed secret's attributes change", func() {
+		Expect(r.SavePreviousSecret(ctx, *applyManagedSecret("v1", map[string]string{"API_KEY": "one"}), *dopplerSecret)).To(Succeed())
+		applyManagedSecret("v2", map[string]string{"API_KEY": "two"})
+		dopplerAPI.setSecrets("v2", map[string]string{"API_KEY": "two"})
+		rolledBack, err := r.ReconcileRollback(ctx, dopplerSecret, WorkloadReloadResult{FailedWorkloads: []string{"Deployment " + namespace + "/api"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledBack).To(BeTrue())
+
+		dopplerSecret.Spec.ManagedSecretRef.Labels = map[string]string{"team": "backend"}
+		dopplerSecret.Spec.ManagedSecretRef.Annotations = map[string]string{"example.com/owner": "backend"}
+		_, err = r.UpdateSecret(ctx, *dopplerSecret)
+		Expect(err).NotTo(HaveOccurred())
+		managedSecret := getSecret("managed")
+		Expect(managedSecret.Data).To(Equal(map[string][]byte{"API_KEY": []byte("one")}))
+		Expect(managedSecret.Annotations).To(HaveKeyWithValue(kubeSecretVersionAnnotation, "v1"))
+		Expect(managedSecret.Labels).To(HaveKeyWithValue("team", "backend"))
+		Expect(managedSecret.Annotations).To(HaveKeyWithValue("example.com/owner", "backend"))
+
+		rolledBack, err = r.ReconcileRollback(ctx, dopplerSecret, WorkloadReloadResult{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledBack).To(BeFalse())
+		Expect(dopplerSecret.Status.Rollback).NotTo(BeNil())
+	})
+
+	It("deletes the previous secret once rollback is disabled", func() {
+		Expect(r.SavePreviousSecret(ctx, *applyManagedSecret("v1", map[string]string{"API_KEY": "one"}), *dopplerSecret)).To(Succeed())
+
+		dopplerSecret.Spec.Reload.RollbackOnFailedRollout = false
+		rolledBack, err := r.ReconcileRollback(ctx, dopplerSecret, WorkloadReloadResult{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rolledBack).To(BeFalse())
+
+		err = k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: GetPreviousSecretName("managed")}, &corev1.Secret{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+})
+
+// Returns a reconciler whose fake client holds a token secret and a DopplerSecret with rollback enabled, syncing from a fake Doppler API
+func newTestRollbackReconciler(t *testing.T) (*DopplerSecretReconciler, *fakeDopplerAPI, *secretsv1alpha1.DopplerSecret) {
+	t.Helper()
+	dopplerAPI := &fakeDopplerAPI{}
+	server := httptest.NewServer(dopplerAPI)
+	t.Cleanup(server.Close)
+	dopplerSecret := &secretsv1alpha1.DopplerSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "dopplersecret", Namespace: "default"},
+		Spec: secretsv1alpha1.DopplerSecretSpec{
+			TokenSecretRef:   secretsv1alpha1.TokenSecretReference{Name: "doppler-token"},
+			ManagedSecretRef: secretsv1alpha1.ManagedSecretReference{Name: "managed", Namespace: "default", Type: string(corev1.SecretTypeOpaque)},
+			Host:             server.URL,
+			Reload:           secretsv1alpha1.ReloadSpec{RollbackOnFailedRollout: true},
+		},
+	}
+	tokenSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "doppler-token", Namespace: "default"},
+		Data:       map[string][]byte{kubeSecretServiceTokenKey: []byte("dp.st.test")},
+	}
+	r := &DopplerSecretReconciler{
+		Client: newTestApplyClientBuilder(t).
+			WithObjects(dopplerSecret, tokenSecret).
+			WithStatusSubresource(&secretsv1alpha1.DopplerSecret{}).
+			Build(),
+		Log:      logr.Discard(),
+		Recorder: record.NewFakeRecorder(100),
+		Rollouts: NewRolloutOrchestrator(0),
+	}
+	return r, dopplerAPI, dopplerSecret
+}
+
+// Applies the managed secret at the given version, as the operator would after syncing it
+func applyTestManagedSecret(t *testing.T, r *DopplerSecretReconciler, dopplerSecret *secretsv1alpha1.DopplerSecret, eTag string, secrets map[string]string) *corev1.Secret {
+	t.Helper()
+	salt := "test-salt"
+	if existing, err := r.GetReferencedSecret(context.Background(), getManagedSecretNamespacedName(*dopplerSecret)); err == nil {
+		salt = existing.Annotations[kubeSecretKeyHashesSaltAnnotation]
+	}
+	secret, err := BuildManagedSecret(*dopplerSecret, secretsResultFor(eTag, secrets), salt)
+	if err != nil {
+		t.Fatalf("unable to build managed secret: %v", err)
+	}
+	if err := r.applyManagedSecret(context.Background(), secret); err != nil {
+		t.Fatalf("unable to apply managed secret: %v", err)
+	}
+	return getTestSecret(t, r, secret.Name)
+}
+
+func getTestSecret(t *testing.T, r *DopplerSecretReconciler, name string) *corev1.Secret {
+	t.Helper()
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: name}, secret); err != nil {
+		t.Fatalf("unable to fetch secret %s: %v", name, err)
+	}
+	return secret
+}
+
+func TestSavePreviousSecret(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("copies only the keys written by the operator", func(t *testing.T) {
+		r, _, dopplerSecret := newTestRollbackReconciler(t)
+		managedSecret := applyTestManagedSecret(t, r, dopplerSecret, "v1", map[string]string{"API_KEY": "one", "DB_URL": "postgres://one"})
+		managedSecret.Data["ADDED_BY_OTHERS"] = []byte("other")
+		if err := r.Client.Update(ctx, managedSecret); err != nil {
+			t.Fatalf("unable to update managed secret: %v", err)
+		}
+
+		if err := r.SavePreviousSecret(ctx, *getTestSecret(t, r, "managed"), *dopplerSecret); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		previousSecret := getTestSecret(t, r, GetPreviousSecretName("managed"))
+		expected := map[string][]byte{"API_KEY": []byte("one"), "DB_URL": []byte("postgres://one")}
+		if !reflect.DeepEqual(previousSecret.Data, expected) {
+			t.Errorf("expected previous secret data %v, got %v", expected, previousSecret.Data)
+		}
+		if previousSecret.Annotations[kubeSecretVersionAnnotation] != "v1" || previousSecret.Annotations[kubeSecretManagedByAnnotation] != dopplerSecret.GetNamespacedName() {
+			t.Errorf("unexpected previous secret annotations %v", previousSecret.Annotations)
+		}
+		if previousSecret.Labels[kubeSecretSubtypeLabel] != previousSecretSubtype {
+			t.Errorf("unexpected previous secret labels %v", previousSecret.Labels)
+		}
+
+		// Saving again replaces the previous payload
+		managedSecret = applyTestManagedSecret(t, r, dopplerSecret, "v2", map[string]string{"API_KEY": "two"})
+		if err := r.SavePreviousSecret(ctx, *managedSecret, *dopplerSecret); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		previousSecret = getTestSecret(t, r, GetPreviousSecretName("managed"))
+		if !reflect.DeepEqual(previousSecret.Data, map[string][]byte{"API_KEY": []byte("two")}) || previousSecret.Annotations[kubeSecretVersionAnnotation] != "v2" {
+			t.Errorf("expected the previous secret to be replaced with v2, got %v %v", previousSecret.Annotations, previousSecret.Data)
+		}
+	})
+
+	t.Run("doesn't overwrite a previous secret which isn't managed by the DopplerSecret", func(t *testing.T) {
+		r, _, dopplerSecret := newTestRollbackReconciler(t)
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: GetPreviousSecretName("managed"), Namespace: "default"},
+			Data:       map[string][]byte{"UNRELATED": []byte("keep")},
+		}
+		if err := r.Client.Create(ctx, existing); err != nil {
+			t.Fatalf("unable to create secret: %v", err)
+		}
+		managedSecret := applyTestManagedSecret(t, r, dopplerSecret, "v1", map[string]string{"API_KEY": "one"})
+
+		err := r.SavePreviousSecret(ctx, *managedSecret, *dopplerSecret)
+		var ownershipConflict *OwnershipConflictError
+		if !errors.As(err, &ownershipConflict) {
+			t.Fatalf("expected an ownership conflict, got %v", err)
+		}
+		if data := getTestSecret(t, r, GetPreviousSecretName("managed")).Data; !reflect.DeepEqual(data, existing.Data) {
+			t.Errorf("expected the unmanaged secret to be left alone, got %v", data)
+		}
+
+		dopplerSecret.Spec.ManagedSecretRef.Adopt = true
+		if err := r.SavePreviousSecret(ctx, *managedSecret, *dopplerSecret); err != nil {
+			t.Fatalf("expected an adopting DopplerSecret to take over the previous secret, got %v", err)
+		}
+		if data := getTestSecret(t, r, GetPreviousSecretName("managed")).Data; !reflect.DeepEqual(data, map[string][]byte{"API_KEY": []byte("one")}) {
+			t.Errorf("expected the adopted previous secret to be overwritten, got %v", data)
+		}
+	})
+}
+
+func TestRestorePreviousSecret(t *testing.T) {
+	ctx := context.Background()
+	r, _, dopplerSecret := newTestRollbackReconciler(t)
+	if err := r.SavePreviousSecret(ctx, *applyTestManagedSecret(t, r, dopplerSecret, "v1", map[string]string{"API_KEY": "one"}), *dopplerSecret); err != nil {
+		t.Fatalf("unable to save previous secret: %v", err)
+	}
+	managedSecret := applyTestManagedSecret(t, r, dopplerSecret, "v2", map[string]string{"API_KEY": "two", "NEW_KEY": "new"})
+	managedSecret.Data["ADDED_BY_OTHERS"] = []byte("other")
+	if err := r.Client.Update(ctx, managedSecret); err != nil {
+		t.Fatalf("unable to update managed secret: %v", err)
+	}
+	salt := managedSecret.Annotations[kubeSecretKeyHashesSaltAnnotation]
+	dopplerSecret.Spec.ManagedSecretRef.Labels = map[string]string{"team": "backend"}
+
+	restoredSecret, err := r.restorePreviousSecret(ctx, *dopplerSecret, getTestSecret(t, r, "managed"), getTestSecret(t, r, GetPreviousSecretName("managed")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	managedSecret = getTestSecret(t, r, "managed")
+	expected := map[string][]byte{"API_KEY": []byte("one"), "ADDED_BY_OTHERS": []byte("other")}
+	if !reflect.DeepEqual(managedSecret.Data, expected) {
+		t.Errorf("expected restored data %v, got %v", expected, managedSecret.Data)
+	}
+	if managedSecret.Annotations[kubeSecretVersionAnnotation] != "v1" || restoredSecret.Annotations[kubeSecretVersionAnnotation] != "v1" {
+		t.Errorf("expected the restored version to be v1, got %v", managedSecret.Annotations)
+	}
+	keyHashes, err := GetKeyHashesAnnotation(map[string][]byte{"API_KEY": []byte("one")}, salt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if managedSecret.Annotations[kubeSecretKeyHashesSaltAnnotation] != salt || managedSecret.Annotations[kubeSecretKeyHashesAnnotation] != keyHashes {
+		t.Errorf("expected the key hashes of the restored data with the existing salt, got %v", managedSecret.Annotations)
+	}
+	if managedSecret.Labels["team"] != "backend" {
+		t.Errorf("expected the DopplerSecret's current labels to be applied, got %v", managedSecret.Labels)
+	}
+}
+
+func TestUpdateSecretHoldsRolledBackSecret(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		change func(t *testing.T, r *DopplerSecretReconciler, dopplerSecret *secretsv1alpha1.DopplerSecret)
+		check  func(t *testing.T, managedSecret *corev1.Secret)
+		events []string
+	}{
+		{
+			name:   "no changes",
+			change: func(t *testing.T, r *DopplerSecretReconciler, dopplerSecret *secretsv1alpha1.DopplerSecret) {},
+		},
+		{
+			name: "labels and annotations changed",
+			change: func(t *testing.T, r *DopplerSecretReconciler, dopplerSecret *secretsv1alpha1.DopplerSecret) {
+				dopplerSecret.Spec.ManagedSecretRef.Labels = map[string]string{"team": "backend"}
+				dopplerSecret.Spec.ManagedSecretRef.Annotations = map[string]string{"example.com/owner": "backend"}
+			},
+			check: func(t *testing.T, managedSecret *corev1.Secret) {
+				if managedSecret.Labels["team"] != "backend" || managedSecret.Annotations["example.com/owner"] != "backend" {
+					t.Errorf("expected the new labels and annotations to be applied, got %v %v", managedSecret.Labels, managedSecret.Annotations)
+				}
+			},
+		},
+		{
+			name: "processors changed",
+			change: func(t *testing.T, r *DopplerSecretReconciler, dopplerSecret *secretsv1alpha1.DopplerSecret) {
+				dopplerSecret.Spec.Processors = secretsv1alpha1.SecretProcessors{"API_KEY": &secretsv1alpha1.SecretProcessor{Type: "plain"}}
+			},
+			check: func(t *testing.T, managedSecret *corev1.Secret) {
+				processorsVersion, _ := GetProcessorsVersion(secretsv1alpha1.SecretProcessors{"API_KEY": &secretsv1alpha1.SecretProcessor{Type: "plain"}})
+				if managedSecret.Annotations[kubeSecretProcessorsVersionAnnotation] != processorsVersion {
+					t.Errorf("expected the processors version to be recorded, got %v", managedSecret.Annotations)
+				}
+			},
+		},
+		{
+			name: "data modified outside of the operator",
+			change: func(t *testing.T, r *DopplerSecretReconciler, dopplerSecret *secretsv1alpha1.DopplerSecret) {
+				managedSecret := getTestSecret(t, r, "managed")
+				managedSecret.Data["API_KEY"] = []byte("tampered")
+				if err := r.Client.Update(context.Background(), managedSecret); err != nil {
+					t.Fatalf("unable to update managed secret: %v", err)
+				}
+			},
+			// Recorded on both the DopplerSecret and the managed secret
+			events: []string{eventReasonDriftCorrected, eventReasonDriftCorrected},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, dopplerAPI, dopplerSecret := newTestRollbackReconciler(t)
+			if err := r.SavePreviousSecret(ctx, *applyTestManagedSecret(t, r, dopplerSecret, "v1", map[string]string{"API_KEY": "one"}), *dopplerSecret); err != nil {
+				t.Fatalf("unable to save previous secret: %v", err)
+			}
+			applyTestManagedSecret(t, r, dopplerSecret, "v2", map[string]string{"API_KEY": "two"})
+			dopplerAPI.setSecrets("v2", map[string]string{"API_KEY": "two"})
+			rolledBack, err := r.ReconcileRollback(ctx, dopplerSecret, WorkloadReloadResult{FailedWorkloads: []string{"Deployment default/api"}})
+			if err != nil || !rolledBack {
+				t.Fatalf("expected the managed secret to be rolled back, got %t %v", rolledBack, err)
+			}
+			// Drain the events recorded so far
+			recorder := r.Recorder.(*record.FakeRecorder)
+			for len(recorder.Events) > 0 {
+				<-recorder.Events
+			}
+
+			test.change(t, r, dopplerSecret)
+			for i := 0; i < 2; i++ {
+				result, err := r.UpdateSecret(ctx, *dopplerSecret)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if result.ETag != "v1" {
+					t.Errorf("expected the synced version to be v1, got %s", result.ETag)
+				}
+			}
+			managedSecret := getTestSecret(t, r, "managed")
+			if !reflect.DeepEqual(managedSecret.Data, map[string][]byte{"API_KEY": []byte("one")}) || managedSecret.Annotations[kubeSecretVersionAnnotation] != "v1" {
+				t.Errorf("expected the rolled back secret to be held, got %v %v", managedSecret.Annotations[kubeSecretVersionAnnotation], managedSecret.Data)
+			}
+			if test.check != nil {
+				test.check(t, managedSecret)
+			}
+			events := []string{}
+			for len(recorder.Events) > 0 {
+				events = append(events, strings.Fields(<-recorder.Events)[1])
+			}
+			if !reflect.DeepEqual(events, append([]string{}, test.events...)) {
+				t.Errorf("expected events %v, got %v", test.events, events)
+			}
+
+			rolledBack, err = r.ReconcileRollback(ctx, dopplerSecret, WorkloadReloadResult{})
+			if err != nil || rolledBack || dopplerSecret.Status.Rollback == nil {
+				t.Fatalf("expected the rollback to be kept, got %t %v %+v", rolledBack, err, dopplerSecret.Status.Rollback)
+			}
+
+			dopplerAPI.setSecrets("v3", map[string]string{"API_KEY": "three"})
+			if _, err := r.UpdateSecret(ctx, *dopplerSecret); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			managedSecret = getTestSecret(t, r, "managed")
+			if !reflect.DeepEqual(managedSecret.Data, map[string][]byte{"API_KEY": []byte("three")}) || managedSecret.Annotations[kubeSecretVersionAnnotation] != "v3" {
+				t.Errorf("expected syncing to resume at v3, got %v %v", managedSecret.Annotations[kubeSecretVersionAnnotation], managedSecret.Data)
+			}
+		})
+	}
+}
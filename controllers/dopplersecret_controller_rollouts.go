@@ -0,0 +1,237 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// RolloutState is the state of a workload's most recent rollout
+type RolloutState string
+
+const (
+	RolloutStateProgressing RolloutState = "Progressing"
+	RolloutStateComplete    RolloutState = "Complete"
+	RolloutStateFailed      RolloutState = "Failed"
+)
+
+const (
+	// How often to check on restarted workloads while waiting for them to become available
+	rolloutProgressCheckInterval = 10 * time.Second
+	// The minimum time to wait before restarting the next batch of workloads
+	minBatchRequeueDuration = time.Second
+	// The Progressing condition reason used by Deployments (and compatible workloads) whose rollout has stalled
+	progressDeadlineExceededReason = "ProgressDeadlineExceeded"
+	// How long a restarted workload which is still progressing counts towards the concurrent restart limit.
+	// This matches the default Deployment progress deadline, so a rollout which never completes can't block other restarts indefinitely.
+	maxRolloutSlotDuration = 10 * time.Minute
+)
+
+// RolloutOrchestrator limits the number of workloads rolling out at once across all DopplerSecrets
+// and keeps track of when each DopplerSecret last restarted a batch of workloads.
+type RolloutOrchestrator struct {
+	// The maximum number of workloads rolling out at once, 0 if unlimited
+	maxConcurrency int
+
+	mu sync.Mutex
+	// The workloads restarted by each DopplerSecret which are still rolling out.
+	// State is keyed by the DopplerSecret's namespaced name so it can be released when a reconcile finds the DopplerSecret deleted.
+	inProgress     map[types.NamespacedName]sets.Set[string]
+	lastBatchTimes map[types.NamespacedName]time.Time
+}
+
+// NewRolloutOrchestrator creates a RolloutOrchestrator. A maxConcurrency of 0 allows an unlimited number of concurrent rollouts.
+func NewRolloutOrchestrator(maxConcurrency int) *RolloutOrchestrator {
+	return &RolloutOrchestrator{
+		maxConcurrency: maxConcurrency,
+		inProgress:     map[types.NamespacedName]sets.Set[string]{},
+		lastBatchTimes: map[types.NamespacedName]time.Time{},
+	}
+}
+
+// Records the workloads restarted by a DopplerSecret which are still rolling out, replacing those previously recorded
+func (o *RolloutOrchestrator) setInProgress(key types.NamespacedName, workloads sets.Set[string]) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if workloads.Len() == 0 {
+		delete(o.inProgress, key)
+		return
+	}
+	o.inProgress[key] = workloads
+}
+
+// Reserves slots for as many of the workloads as the concurrent rollout limit allows, counting the rollouts in progress across all DopplerSecrets.
+// Returns the workloads which may be restarted now. They're recorded as in progress until the DopplerSecret's next call to setInProgress.
+func (o *RolloutOrchestrator) reserve(key types.NamespacedName, workloads []string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.maxConcurrency <= 0 {
+		return workloads
+	}
+	numInProgress := 0
+	for _, inProgress := range o.inProgress {
+		numInProgress += inProgress.Len()
+	}
+	available := max(o.maxConcurrency-numInProgress, 0)
+	if len(workloads) > available {
+		workloads = workloads[:available]
+	}
+	if len(workloads) > 0 {
+		if o.inProgress[key] == nil {
+			o.inProgress[key] = sets.New[string]()
+		}
+		o.inProgress[key].Insert(workloads...)
+	}
+	return workloads
+}
+
+// Forgets all state kept for a DopplerSecret, e.g. once it's deleted
+func (o *RolloutOrchestrator) forget(key types.NamespacedName) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.inProgress, key)
+	delete(o.lastBatchTimes, key)
+}
+
+func (o *RolloutOrchestrator) getLastBatchTime(key types.NamespacedName) (time.Time, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	lastBatchTime, ok := o.lastBatchTimes[key]
+	return lastBatchTime, ok
+}
+
+func (o *RolloutOrchestrator) setLastBatchTime(key types.NamespacedName, lastBatchTime time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastBatchTimes[key] = lastBatchTime
+}
+
+func (o *RolloutOrchestrator) clearLastBatchTime(key types.NamespacedName) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.lastBatchTimes, key)
+}
+
+func getDeploymentRolloutState(deployment *appsv1.Deployment) RolloutState {
+	if deployment.Generation > deployment.Status.ObservedGeneration {
+		return RolloutStateProgressing
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == progressDeadlineExceededReason {
+			return RolloutStateFailed
+		}
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	if deployment.Status.UpdatedReplicas < replicas ||
+		deployment.Status.Replicas > deployment.Status.UpdatedReplicas ||
+		deployment.Status.AvailableReplicas < deployment.Status.UpdatedReplicas {
+		return RolloutStateProgressing
+	}
+	return RolloutStateComplete
+}
+
+func getStatefulSetRolloutState(statefulSet *appsv1.StatefulSet) RolloutState {
+	if statefulSet.Generation > statefulSet.Status.ObservedGeneration {
+		return RolloutStateProgressing
+	}
+	if statefulSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		return RolloutStateComplete
+	}
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+	if statefulSet.Status.ReadyReplicas < replicas {
+		return RolloutStateProgressing
+	}
+	rollingUpdate := statefulSet.Spec.UpdateStrategy.RollingUpdate
+	if rollingUpdate != nil && rollingUpdate.Partition != nil && *rollingUpdate.Partition > 0 {
+		if statefulSet.Status.UpdatedReplicas < replicas-*rollingUpdate.Partition {
+			return RolloutStateProgressing
+		}
+		return RolloutStateComplete
+	}
+	if statefulSet.Status.UpdateRevision != statefulSet.Status.CurrentRevision {
+		return RolloutStateProgressing
+	}
+	return RolloutStateComplete
+}
+
+func getDaemonSetRolloutState(daemonSet *appsv1.DaemonSet) RolloutState {
+	if daemonSet.Generation > daemonSet.Status.ObservedGeneration {
+		return RolloutStateProgressing
+	}
+	if daemonSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
+		return RolloutStateComplete
+	}
+	if daemonSet.Status.UpdatedNumberScheduled < daemonSet.Status.DesiredNumberScheduled ||
+		daemonSet.Status.NumberAvailable < daemonSet.Status.DesiredNumberScheduled {
+		return RolloutStateProgressing
+	}
+	return RolloutStateComplete
+}
+
+func getReplicaSetRolloutState(replicaSet *appsv1.ReplicaSet) RolloutState {
+	if replicaSet.Generation > replicaSet.Status.ObservedGeneration {
+		return RolloutStateProgressing
+	}
+	replicas := int32(1)
+	if replicaSet.Spec.Replicas != nil {
+		replicas = *replicaSet.Spec.Replicas
+	}
+	if replicaSet.Status.AvailableReplicas < replicas {
+		return RolloutStateProgressing
+	}
+	return RolloutStateComplete
+}
+
+// Determines the rollout state of an arbitrary workload from the conventional `status.observedGeneration`
+// field and `Progressing`, `Available` or `Ready` conditions. Workloads without these fields are always considered complete.
+func getUnstructuredRolloutState(workload *unstructured.Unstructured) RolloutState {
+	observedGeneration, found, err := unstructured.NestedInt64(workload.Object, "status", "observedGeneration")
+	if err == nil && found && workload.GetGeneration() > observedGeneration {
+		return RolloutStateProgressing
+	}
+	conditions, found, err := unstructured.NestedSlice(workload.Object, "status", "conditions")
+	if err != nil || !found {
+		return RolloutStateComplete
+	}
+	state := RolloutStateComplete
+	for _, condition := range conditions {
+		conditionMap, ok := condition.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		conditionType := conditionMap["type"]
+		if conditionType == "Progressing" && conditionMap["reason"] == progressDeadlineExceededReason {
+			return RolloutStateFailed
+		}
+		if (conditionType == "Available" || conditionType == "Ready") && conditionMap["status"] != "True" {
+			state = RolloutStateProgressing
+		}
+	}
+	return state
+}
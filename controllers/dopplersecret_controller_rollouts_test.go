@@ -0,0 +1,108 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var (
+	testDopplerSecretA = types.NamespacedName{Namespace: "default", Name: "a"}
+	testDopplerSecretB = types.NamespacedName{Namespace: "default", Name: "b"}
+	testDopplerSecretC = types.NamespacedName{Namespace: "default", Name: "c"}
+)
+
+func TestRolloutOrchestratorReserve(t *testing.T) {
+	orchestrator := NewRolloutOrchestrator(3)
+
+	reserved := orchestrator.reserve(testDopplerSecretA, []string{"Deployment default/api", "Deployment default/worker"})
+	if !reflect.DeepEqual(reserved, []string{"Deployment default/api", "Deployment default/worker"}) {
+		t.Fatalf("expected both workloads to be reserved, got %v", reserved)
+	}
+
+	// Reserved workloads hold their slots until they're no longer recorded as in progress
+	reserved = orchestrator.reserve(testDopplerSecretB, []string{"Deployment other/api", "Deployment other/worker"})
+	if !reflect.DeepEqual(reserved, []string{"Deployment other/api"}) {
+		t.Fatalf("expected only one workload to be reserved, got %v", reserved)
+	}
+	reserved = orchestrator.reserve(testDopplerSecretB, []string{"Deployment other/worker"})
+	if len(reserved) != 0 {
+		t.Fatalf("expected no slots to be available, got %v", reserved)
+	}
+
+	// One of the first DopplerSecret's rollouts completed
+	orchestrator.setInProgress(testDopplerSecretA, sets.New("Deployment default/worker"))
+	reserved = orchestrator.reserve(testDopplerSecretB, []string{"Deployment other/worker"})
+	if !reflect.DeepEqual(reserved, []string{"Deployment other/worker"}) {
+		t.Fatalf("expected the released slot to be reserved, got %v", reserved)
+	}
+
+	// Deleted DopplerSecrets release their slots
+	orchestrator.forget(testDopplerSecretA)
+	reserved = orchestrator.reserve(testDopplerSecretC, []string{"Deployment third/api", "Deployment third/worker"})
+	if !reflect.DeepEqual(reserved, []string{"Deployment third/api"}) {
+		t.Fatalf("expected one workload to be reserved, got %v", reserved)
+	}
+}
+
+func TestRolloutOrchestratorUnlimited(t *testing.T) {
+	orchestrator := NewRolloutOrchestrator(0)
+	workloads := []string{"Deployment default/api", "Deployment default/worker"}
+	for i := 0; i < 3; i++ {
+		if reserved := orchestrator.reserve(testDopplerSecretA, workloads); !reflect.DeepEqual(reserved, workloads) {
+			t.Fatalf("expected all workloads to be reserved, got %v", reserved)
+		}
+	}
+}
+
+func TestRolloutOrchestratorReleasesDeletedDopplerSecrets(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "doppler-operator-system")
+	orchestrator := NewRolloutOrchestrator(1)
+	r := &DopplerSecretReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(newTestScheme(t)).Build(),
+		Log:      logr.Discard(),
+		Rollouts: orchestrator,
+	}
+
+	if reserved := orchestrator.reserve(testDopplerSecretA, []string{"Deployment default/api"}); len(reserved) != 1 {
+		t.Fatalf("expected the workload to be reserved, got %v", reserved)
+	}
+	if reserved := orchestrator.reserve(testDopplerSecretB, []string{"Deployment default/worker"}); len(reserved) != 0 {
+		t.Fatalf("expected no slots to be available, got %v", reserved)
+	}
+	orchestrator.setLastBatchTime(testDopplerSecretA, time.Now())
+
+	// The DopplerSecret was deleted without a finalizer, so its next reconcile doesn't find it
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: testDopplerSecretA}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reserved := orchestrator.reserve(testDopplerSecretB, []string{"Deployment default/worker"}); len(reserved) != 1 {
+		t.Fatalf("expected the deleted DopplerSecret's slot to be released, got %v", reserved)
+	}
+	if _, ok := orchestrator.getLastBatchTime(testDopplerSecretA); ok {
+		t.Errorf("expected the deleted DopplerSecret's last batch time to be forgotten")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+// ResyncSchedule spreads DopplerSecret resyncs out over time so they don't all call the Doppler API at once.
+// Each DopplerSecret gets a consistent offset derived from its UID, so resyncs stay spread out across reconciles and restarts.
+type ResyncSchedule struct {
+	// The maximum fraction of the resync interval added to each DopplerSecret's interval
+	Jitter float64
+
+	// The window over which the initial reconciles of existing DopplerSecrets are spread after the operator starts
+	StartupStagger time.Duration
+
+	startTime time.Time
+	// The UIDs of the DopplerSecrets reconciled since the operator started
+	started sync.Map
+}
+
+// NewResyncSchedule creates a schedule starting now
+func NewResyncSchedule(jitter float64, startupStagger time.Duration) *ResyncSchedule {
+	return &ResyncSchedule{
+		Jitter:         jitter,
+		StartupStagger: startupStagger,
+		startTime:      time.Now(),
+	}
+}
+
+// Returns a number in [0, 1) which is always the same for a given UID
+func getSchedulePhase(uid types.UID) float64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(uid))
+	return float64(hash.Sum32()) / (math.MaxUint32 + 1)
+}
+
+// ResyncInterval returns the resync interval for a DopplerSecret with its jitter added
+func (s *ResyncSchedule) ResyncInterval(dopplerSecret secretsv1alpha1.DopplerSecret, interval time.Duration) time.Duration {
+	return interval + time.Duration(getSchedulePhase(dopplerSecret.UID)*s.Jitter*float64(interval))
+}
+
+// StartupDelay returns how long to wait before the first reconcile of a DopplerSecret since the operator started.
+// DopplerSecrets which are new or were changed while the operator was down aren't delayed.
+func (s *ResyncSchedule) StartupDelay(dopplerSecret secretsv1alpha1.DopplerSecret) time.Duration {
+	if s.StartupStagger <= 0 {
+		return 0
+	}
+	if _, reconciled := s.started.LoadOrStore(dopplerSecret.UID, true); reconciled {
+		return 0
+	}
+	if dopplerSecret.Status.ObservedGeneration != dopplerSecret.Generation {
+		return 0
+	}
+	return time.Until(s.startTime.Add(time.Duration(getSchedulePhase(dopplerSecret.UID) * float64(s.StartupStagger))))
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+func TestResyncInterval(t *testing.T) {
+	schedule := NewResyncSchedule(0.1, 0)
+	interval := time.Minute
+	intervals := map[time.Duration]bool{}
+	for _, uid := range []types.UID{"a", "b", "c", "d"} {
+		dopplerSecret := secretsv1alpha1.DopplerSecret{ObjectMeta: metav1.ObjectMeta{UID: uid}}
+		resyncInterval := schedule.ResyncInterval(dopplerSecret, interval)
+		if resyncInterval < interval || resyncInterval >= interval+6*time.Second {
+			t.Errorf("expected interval between 60s and 66s for %s, got %v", uid, resyncInterval)
+		}
+		if schedule.ResyncInterval(dopplerSecret, interval) != resyncInterval {
+			t.Errorf("expected a consistent interval for %s", uid)
+		}
+		intervals[resyncInterval] = true
+	}
+	if len(intervals) < 2 {
+		t.Error("expected intervals to be spread out")
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	schedule := NewResyncSchedule(0, time.Hour)
+	existing := secretsv1alpha1.DopplerSecret{
+		ObjectMeta: metav1.ObjectMeta{UID: "existing", Generation: 2},
+		Status:     secretsv1alpha1.DopplerSecretStatus{ObservedGeneration: 2},
+	}
+	changed := secretsv1alpha1.DopplerSecret{
+		ObjectMeta: metav1.ObjectMeta{UID: "changed", Generation: 3},
+		Status:     secretsv1alpha1.DopplerSecretStatus{ObservedGeneration: 2},
+	}
+
+	if delay := schedule.StartupDelay(existing); delay <= 0 || delay > time.Hour {
+		t.Errorf("expected the first reconcile to be delayed by up to an hour, got %v", delay)
+	}
+	if delay := schedule.StartupDelay(existing); delay != 0 {
+		t.Errorf("expected only the first reconcile to be delayed, got %v", delay)
+	}
+	if delay := schedule.StartupDelay(changed); delay != 0 {
+		t.Errorf("expected a changed DopplerSecret not to be delayed, got %v", delay)
+	}
+}
@@ -17,12 +17,17 @@ limitations under the License.
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"reflect"
+	"maps"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/DopplerHQ/kubernetes-operator/pkg/models"
@@ -31,6 +36,9 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
 	"github.com/DopplerHQ/kubernetes-operator/pkg/api"
@@ -44,13 +52,15 @@ const (
 	kubeSecretDashboardLinkAnnotaion      = "secrets.doppler.com/dashboard-link"
 	kubeSecretManagedByAnnotation         = "secrets.doppler.com/managed-by"
 	kubeSecretLastUpdatedAnnotation       = "secrets.doppler.com/last-updated"
+	kubeSecretKeyHashesAnnotation         = "secrets.doppler.com/key-hashes"
+	kubeSecretKeyHashesSaltAnnotation     = "secrets.doppler.com/key-hashes-salt"
 	kubeSecretServiceTokenKey             = "serviceToken"
 )
 
-var kubeSecretBuiltInAnnotationKeys = []string{kubeSecretVersionAnnotation, kubeSecretProcessorsVersionAnnotation, kubeSecretFormatVersionAnnotation, kubeSecretDashboardLinkAnnotaion, kubeSecretManagedByAnnotation, kubeSecretLastUpdatedAnnotation}
+var kubeSecretBuiltInAnnotationKeys = []string{kubeSecretVersionAnnotation, kubeSecretProcessorsVersionAnnotation, kubeSecretFormatVersionAnnotation, kubeSecretDashboardLinkAnnotaion, kubeSecretManagedByAnnotation, kubeSecretLastUpdatedAnnotation, kubeSecretKeyHashesAnnotation, kubeSecretKeyHashesSaltAnnotation}
 
-// GetDashboardLink gets a link to the Doppler dashboard from a list of Doppler secrets
-func GetDashboardLink(secrets []models.Secret) string {
+// GetProjectAndConfig gets the Doppler project and config slugs from a list of Doppler secrets. Returns empty strings if they weren't synced.
+func GetProjectAndConfig(secrets []models.Secret) (string, string) {
 	var projectSlug string
 	var configSlug string
 	for _, secret := range secrets {
@@ -60,12 +70,41 @@ func GetDashboardLink(secrets []models.Secret) string {
 			configSlug = secret.Value
 		}
 	}
+	return projectSlug, configSlug
+}
+
+// GetDashboardLink gets a link to the Doppler dashboard from a list of Doppler secrets
+func GetDashboardLink(secrets []models.Secret) string {
+	projectSlug, configSlug := GetProjectAndConfig(secrets)
 	if projectSlug == "" || configSlug == "" {
 		return "https://dashboard.doppler.com/workplace"
 	}
 	return fmt.Sprintf("https://dashboard.doppler.com/workplace/projects/%v/configs/%v", projectSlug, configSlug)
 }
 
+// SecretSyncResult describes the managed secret after a successful sync
+type SecretSyncResult struct {
+	// The Doppler secrets version in the managed secret
+	ETag string
+	// The Doppler project and config, only known when the secrets were fetched and include DOPPLER_PROJECT and DOPPLER_CONFIG
+	Project string
+	Config  string
+	// The number of keys written to the managed secret by the operator
+	KeyCount int
+}
+
+// Gets the sync result for a managed secret from the annotations written by the operator
+func getSecretSyncResult(secret corev1.Secret) SecretSyncResult {
+	result := SecretSyncResult{
+		ETag:     secret.Annotations[kubeSecretVersionAnnotation],
+		KeyCount: len(secret.Data),
+	}
+	if keyHashes, ok := ParseKeyHashesAnnotation(secret); ok {
+		result.KeyCount = len(keyHashes)
+	}
+	return result
+}
+
 // GetReferencedSecret gets a Kubernetes secret from a SecretReference
 func (r *DopplerSecretReconciler) GetReferencedSecret(ctx context.Context, namespacedName types.NamespacedName) (*corev1.Secret, error) {
 	existingKubeSecret := &corev1.Secret{}
@@ -152,15 +191,70 @@ func GetKubeSecretAnnotations(secretsResult models.SecretsResult, processorsVers
 	return annotations
 }
 
-// GetKubeSecretLabels generates Kube labels from the provided managed secret spec values
-func GetKubeSecretLabels(additionalLabels map[string]string) map[string]string {
+// NewKeyHashesSalt generates a random salt for the key hashes of a managed secret
+func NewKeyHashesSalt() (string, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("Failed to generate key hashes salt: %w", err)
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// Returns the key hashes salt of an existing managed secret, or a new salt if the secret doesn't have one yet
+func getKeyHashesSalt(secret *corev1.Secret) (string, error) {
+	if secret != nil {
+		if salt := secret.Annotations[kubeSecretKeyHashesSaltAnnotation]; salt != "" {
+			return salt, nil
+		}
+	}
+	return NewKeyHashesSalt()
+}
+
+// GetKeyHashes generates an HMAC-SHA256 of the value of each key in the Kube secret data, keyed with the managed secret's salt.
+// The salt is only stored in the managed secret so low-entropy values can't be recovered by hashing guesses.
+func GetKeyHashes(secretData map[string][]byte, salt string) map[string]string {
+	keyHashes := map[string]string{}
+	for k, v := range secretData {
+		mac := hmac.New(sha256.New, []byte(salt))
+		mac.Write(v)
+		keyHashes[k] = fmt.Sprintf("%x", mac.Sum(nil))
+	}
+	return keyHashes
+}
+
+// GetKeyHashesAnnotation generates the key hashes annotation value for the Kube secret data
+func GetKeyHashesAnnotation(secretData map[string][]byte, salt string) (string, error) {
+	keyHashesJson, err := json.Marshal(GetKeyHashes(secretData, salt))
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshal key hashes: %w", err)
+	}
+	return string(keyHashesJson), nil
+}
+
+// ParseKeyHashesAnnotation reads the key hashes annotation from a managed secret. Returns false if the annotation is missing or invalid.
+func ParseKeyHashesAnnotation(secret corev1.Secret) (map[string]string, bool) {
+	keyHashesJson, ok := secret.Annotations[kubeSecretKeyHashesAnnotation]
+	if !ok {
+		return nil, false
+	}
+	keyHashes := map[string]string{}
+	if err := json.Unmarshal([]byte(keyHashesJson), &keyHashes); err != nil {
+		return nil, false
+	}
+	return keyHashes, true
+}
+
+// GetKubeSecretLabels generates Kube labels from the provided managed secret spec values and deletion policy
+func GetKubeSecretLabels(additionalLabels map[string]string, deletionPolicy DeletionPolicy) map[string]string {
 	labels := map[string]string{}
 
 	for k, v := range additionalLabels {
 		labels[k] = v
 	}
 
-	labels["secrets.doppler.com/subtype"] = "dopplerSecret"
+	labels[kubeSecretSubtypeLabel] = "dopplerSecret"
+	// Recorded so the orphaned secret sweeper can leave retained secrets alone once the DopplerSecret is deleted
+	labels[kubeSecretDeletionPolicyLabel] = string(deletionPolicy)
 
 	return labels
 }
@@ -177,65 +271,201 @@ func GetProcessorsVersion(processors secretsv1alpha1.SecretProcessors) (string,
 	return fmt.Sprintf("%x", sha256.Sum256(processorsJson)), nil
 }
 
-// CreateManagedSecret creates a managed Kubernetes secret
-func (r *DopplerSecretReconciler) CreateManagedSecret(ctx context.Context, dopplerSecret secretsv1alpha1.DopplerSecret, secretsResult models.SecretsResult) error {
+// BuildManagedSecret builds the managed Kubernetes secret to be applied from a Doppler API secrets result.
+// The key hashes are keyed with salt, which should be kept for the lifetime of the secret so workloads aren't restarted unnecessarily.
+func BuildManagedSecret(dopplerSecret secretsv1alpha1.DopplerSecret, secretsResult models.SecretsResult, salt string) (*corev1.Secret, error) {
 	var includeSecretsByDefault bool
 	if dopplerSecret.Spec.ManagedSecretRef.Type == string(corev1.SecretTypeOpaque) {
 		includeSecretsByDefault = true
 	}
 	secretData, dataErr := GetKubeSecretData(secretsResult, dopplerSecret.Spec.Processors, includeSecretsByDefault)
 	if dataErr != nil {
-		return fmt.Errorf("Failed to build Kubernetes secret data: %w", dataErr)
+		return nil, fmt.Errorf("Failed to build Kubernetes secret data: %w", dataErr)
 	}
 	processorsVersion, versErr := GetProcessorsVersion(dopplerSecret.Spec.Processors)
 	if versErr != nil {
-		return fmt.Errorf("Failed to compute processors version: %w", versErr)
+		return nil, fmt.Errorf("Failed to compute processors version: %w", versErr)
 	}
-	newKubeSecret := &corev1.Secret{
+	keyHashes, hashErr := GetKeyHashesAnnotation(secretData, salt)
+	if hashErr != nil {
+		return nil, fmt.Errorf("Failed to compute key hashes: %w", hashErr)
+	}
+	annotations := GetKubeSecretAnnotations(secretsResult, processorsVersion, dopplerSecret.Spec.Format, dopplerSecret.Spec.ManagedSecretRef.Annotations, dopplerSecret.GetNamespacedName())
+	annotations[kubeSecretKeyHashesAnnotation] = keyHashes
+	annotations[kubeSecretKeyHashesSaltAnnotation] = salt
+	return &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        dopplerSecret.Spec.ManagedSecretRef.Name,
 			Namespace:   dopplerSecret.Spec.ManagedSecretRef.Namespace,
-			Annotations: GetKubeSecretAnnotations(secretsResult, processorsVersion, dopplerSecret.Spec.Format, dopplerSecret.Spec.ManagedSecretRef.Annotations, dopplerSecret.GetNamespacedName()),
-			Labels:      GetKubeSecretLabels(dopplerSecret.Spec.ManagedSecretRef.Labels),
+			Annotations: annotations,
+			Labels:      GetKubeSecretLabels(dopplerSecret.Spec.ManagedSecretRef.Labels, getDeletionPolicy(dopplerSecret)),
 		},
 		Type: corev1.SecretType(dopplerSecret.Spec.ManagedSecretRef.Type),
 		Data: secretData,
+	}, nil
+}
+
+// KeyDiff lists the keys of a managed secret which were added, removed or changed by a sync
+type KeyDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// IsEmpty returns true if no keys were added, removed or changed
+func (d KeyDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d KeyDiff) String() string {
+	format := func(keys []string) string {
+		if len(keys) == 0 {
+			return "none"
+		}
+		return strings.Join(keys, ", ")
 	}
-	err := r.Client.Create(ctx, newKubeSecret)
-	if err != nil {
-		return fmt.Errorf("Failed to create Kubernetes secret: %w", err)
+	return fmt.Sprintf("Added: %s. Removed: %s. Changed: %s.", format(d.Added), format(d.Removed), format(d.Changed))
+}
+
+// GetKeyDiff compares the keys previously written by the operator to a managed secret with the new secret data.
+// Keys written by others aren't included.
+func GetKeyDiff(existingData map[string][]byte, previousKeys sets.Set[string], data map[string][]byte) KeyDiff {
+	diff := KeyDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for k, v := range data {
+		if !previousKeys.Has(k) {
+			diff.Added = append(diff.Added, k)
+		} else if existingValue, ok := existingData[k]; !ok || !bytes.Equal(existingValue, v) {
+			diff.Changed = append(diff.Changed, k)
+		}
 	}
-	r.Log.Info("[/] Successfully created new Kubernetes secret")
-	return nil
+	for k := range previousKeys {
+		if _, ok := data[k]; !ok {
+			diff.Removed = append(diff.Removed, k)
+		}
+	}
+	slices.Sort(diff.Added)
+	slices.Sort(diff.Removed)
+	slices.Sort(diff.Changed)
+	return diff
 }
 
-// UpdateManagedSecret updates a managed Kubernetes secret
-func (r *DopplerSecretReconciler) UpdateManagedSecret(ctx context.Context, secret corev1.Secret, dopplerSecret secretsv1alpha1.DopplerSecret, secretsResult models.SecretsResult) error {
-	var includeSecretsByDefault bool
-	if dopplerSecret.Spec.ManagedSecretRef.Type == string(corev1.SecretTypeOpaque) {
-		includeSecretsByDefault = true
+// Returns the keys previously written by the operator to a managed secret
+func getPreviousManagedSecretKeys(secret corev1.Secret) sets.Set[string] {
+	fields, _ := GetManagedSecretFields(secret)
+	keys := fields.Data
+	if keyHashes, ok := ParseKeyHashesAnnotation(secret); ok {
+		keys.Insert(slices.Collect(maps.Keys(keyHashes))...)
 	}
-	secretData, dataErr := GetKubeSecretData(secretsResult, dopplerSecret.Spec.Processors, includeSecretsByDefault)
-	if dataErr != nil {
-		return fmt.Errorf("Failed to build Kubernetes secret data: %w", dataErr)
+	return keys
+}
+
+// CreateManagedSecret creates a managed Kubernetes secret and returns the created secret
+func (r *DopplerSecretReconciler) CreateManagedSecret(ctx context.Context, dopplerSecret secretsv1alpha1.DopplerSecret, secretsResult models.SecretsResult) (*corev1.Secret, error) {
+	salt, err := NewKeyHashesSalt()
+	if err != nil {
+		return nil, err
 	}
-	processorsVersion, procsVersErr := GetProcessorsVersion(dopplerSecret.Spec.Processors)
-	if procsVersErr != nil {
-		return fmt.Errorf("Failed to compute processors version: %w", procsVersErr)
+	newKubeSecret, err := BuildManagedSecret(dopplerSecret, secretsResult, salt)
+	if err != nil {
+		return nil, err
 	}
-	secret.Data = secretData
-	secret.ObjectMeta.Annotations = GetKubeSecretAnnotations(secretsResult, processorsVersion, dopplerSecret.Spec.Format, dopplerSecret.Spec.ManagedSecretRef.Annotations, dopplerSecret.GetNamespacedName())
-	secret.ObjectMeta.Labels = GetKubeSecretLabels((dopplerSecret.Spec.ManagedSecretRef.Labels))
-	err := r.Client.Update(ctx, &secret)
+	if err := r.applyManagedSecret(ctx, newKubeSecret); err != nil {
+		return nil, fmt.Errorf("Failed to create Kubernetes secret: %w", err)
+	}
+	diff := GetKeyDiff(nil, sets.New[string](), newKubeSecret.Data)
+	r.Log.Info("[/] Successfully created new Kubernetes secret", "added", diff.Added)
+	r.recordSyncEvent(&dopplerSecret, newKubeSecret, corev1.EventTypeNormal, eventReasonSecretsSynced, "Created managed secret %s/%s at version %s with %d keys. %s",
+		newKubeSecret.Namespace, newKubeSecret.Name, secretsResult.ETag, len(diff.Added), diff)
+	return newKubeSecret, nil
+}
+
+// UpdateManagedSecret updates a managed Kubernetes secret and returns the updated secret. Labels, annotations and keys set by others are preserved.
+// The update fails if the secret changes while it's being written, in which case it's retried against the latest secret.
+func (r *DopplerSecretReconciler) UpdateManagedSecret(ctx context.Context, secret corev1.Secret, dopplerSecret secretsv1alpha1.DopplerSecret, secretsResult models.SecretsResult) (*corev1.Secret, error) {
+	salt, err := getKeyHashesSalt(&secret)
+	if err != nil {
+		return nil, err
+	}
+	newKubeSecret, err := BuildManagedSecret(dopplerSecret, secretsResult, salt)
+	if err != nil {
+		return nil, err
+	}
+	var appliedSecret *corev1.Secret
+	var diff KeyDiff
+	attempt := 0
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		attempt++
+		if attempt > 1 {
+			if err := r.Client.Get(ctx, client.ObjectKeyFromObject(&secret), &secret); err != nil {
+				return err
+			}
+		}
+		appliedSecret = newKubeSecret.DeepCopy()
+		diff, err = r.updateManagedSecret(ctx, &secret, appliedSecret, dopplerSecret, secretsResult)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("Failed to update Kubernetes secret: %w", err)
+		return nil, err
+	}
+	r.Log.Info("[/] Successfully updated existing Kubernetes secret", "added", diff.Added, "removed", diff.Removed, "changed", diff.Changed, "attempts", attempt)
+	r.recordSyncEvent(&dopplerSecret, &secret, corev1.EventTypeNormal, eventReasonSecretsSynced, "Updated managed secret %s/%s to version %s: %d added, %d removed, %d changed. %s",
+		secret.Namespace, secret.Name, secretsResult.ETag, len(diff.Added), len(diff.Removed), len(diff.Changed), diff)
+	return appliedSecret, nil
+}
+
+// Applies the new managed secret on top of the existing secret, as long as the existing secret hasn't changed since it was fetched
+func (r *DopplerSecretReconciler) updateManagedSecret(ctx context.Context, secret *corev1.Secret, newKubeSecret *corev1.Secret, dopplerSecret secretsv1alpha1.DopplerSecret, secretsResult models.SecretsResult) (KeyDiff, error) {
+	if err := r.upgradeManagedSecretFields(ctx, secret); err != nil {
+		return KeyDiff{}, err
+	}
+	diff := GetKeyDiff(secret.Data, getPreviousManagedSecretKeys(*secret), newKubeSecret.Data)
+	if dopplerSecret.Spec.Reload.RollbackOnFailedRollout && secret.Annotations[kubeSecretVersionAnnotation] != secretsResult.ETag {
+		if err := r.SavePreviousSecret(ctx, *secret, dopplerSecret); err != nil {
+			return KeyDiff{}, err
+		}
+	}
+	// Keys which are no longer written, e.g. after a processor or format change, are removed because the operator owns them
+	newKubeSecret.ResourceVersion = secret.ResourceVersion
+	if err := r.applyManagedSecret(ctx, newKubeSecret); err != nil {
+		return KeyDiff{}, fmt.Errorf("Failed to update Kubernetes secret: %w", err)
+	}
+	return diff, nil
+}
+
+// OwnershipConflictError is returned when the managed secret already exists but isn't managed by the DopplerSecret
+type OwnershipConflictError struct {
+	// The namespaced name of the managed secret
+	Secret string
+
+	// The DopplerSecret managing the secret, or empty if the secret isn't managed by the operator
+	ManagedBy string
+}
+
+func (e *OwnershipConflictError) Error() string {
+	if e.ManagedBy == "" {
+		return fmt.Sprintf("Secret %s already exists and isn't managed by the operator. Set managedSecret.adopt to take it over.", e.Secret)
+	}
+	return fmt.Sprintf("Secret %s is managed by DopplerSecret %s. Set managedSecret.adopt to take it over.", e.Secret, e.ManagedBy)
+}
+
+// Checks that an existing secret is managed by the DopplerSecret before it's overwritten
+func checkManagedSecretOwnership(secret corev1.Secret, dopplerSecret secretsv1alpha1.DopplerSecret) error {
+	managedBy, hasManagedBy := secret.Annotations[kubeSecretManagedByAnnotation]
+	if !hasManagedBy && secret.Labels[kubeSecretSubtypeLabel] == "dopplerSecret" {
+		// Secrets created by older versions of the operator are labelled but don't record their DopplerSecret
+		return nil
+	}
+	if managedBy == dopplerSecret.GetNamespacedName() {
+		return nil
+	}
+	return &OwnershipConflictError{
+		Secret:    types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}.String(),
+		ManagedBy: managedBy,
 	}
-	r.Log.Info("[/] Successfully updated existing Kubernetes secret")
-	return nil
 }
 
-// UpdateSecret updates a Kubernetes secret using the configuration specified in a DopplerSecret
-func (r *DopplerSecretReconciler) UpdateSecret(ctx context.Context, dopplerSecret secretsv1alpha1.DopplerSecret) error {
+// UpdateSecret updates a Kubernetes secret using the configuration specified in a DopplerSecret and describes the synced secret
+func (r *DopplerSecretReconciler) UpdateSecret(ctx context.Context, dopplerSecret secretsv1alpha1.DopplerSecret) (SecretSyncResult, error) {
 	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName(), "verifyTLS", dopplerSecret.Spec.VerifyTLS, "host", dopplerSecret.Spec.Host)
 	if dopplerSecret.Spec.ManagedSecretRef.Namespace == "" {
 		dopplerSecret.Spec.ManagedSecretRef.Namespace = dopplerSecret.Namespace
@@ -246,31 +476,40 @@ func (r *DopplerSecretReconciler) UpdateSecret(ctx context.Context, dopplerSecre
 		dopplerSecret.Spec.TokenSecretRef.Namespace = dopplerSecret.Namespace
 	}
 
-	authProvider, err := r.getAuthProvider(ctx, &dopplerSecret)
-	if err != nil {
-		return fmt.Errorf("Failed to get auth provider: %w", err)
-	}
-
-	apiContext, err := authProvider.GetAPIContext(ctx)
-	if err != nil {
-		return fmt.Errorf("Failed to get API context: %w", err)
-	}
-
 	managedSecretNamespacedName := types.NamespacedName{
 		Name:      dopplerSecret.Spec.ManagedSecretRef.Name,
 		Namespace: dopplerSecret.Spec.ManagedSecretRef.Namespace,
 	}
 	existingKubeSecret, err := r.GetReferencedSecret(ctx, managedSecretNamespacedName)
 	if err != nil && !errors.IsNotFound(err) {
-		return fmt.Errorf("Failed to fetch managed secret reference: %w", err)
+		return SecretSyncResult{}, fmt.Errorf("Failed to fetch managed secret reference: %w", err)
+	}
+	if existingKubeSecret != nil && !dopplerSecret.Spec.ManagedSecretRef.Adopt {
+		if err := checkManagedSecretOwnership(*existingKubeSecret, dopplerSecret); err != nil {
+			// The secret belongs to someone else, so the event is only recorded on the DopplerSecret
+			r.recordEvent(&dopplerSecret, corev1.EventTypeWarning, eventReasonOwnershipConflict, "%v", err)
+			return SecretSyncResult{}, err
+		}
 	}
 	if existingKubeSecret != nil && existingKubeSecret.Type != corev1.SecretType(dopplerSecret.Spec.ManagedSecretRef.Type) {
-		return fmt.Errorf("Cannot change existing managed secret type from %v to %v. Delete the managed secret and re-apply the DopplerSecret.", existingKubeSecret.Type, dopplerSecret.Spec.ManagedSecretRef.Type)
+		return SecretSyncResult{}, fmt.Errorf("Cannot change existing managed secret type from %v to %v. Delete the managed secret and re-apply the DopplerSecret.", existingKubeSecret.Type, dopplerSecret.Spec.ManagedSecretRef.Type)
+	}
+
+	authProvider, err := r.getAuthProvider(ctx, &dopplerSecret)
+	if err != nil {
+		r.recordSyncEvent(&dopplerSecret, existingKubeSecret, corev1.EventTypeWarning, eventReasonAuthFailed, "Unable to authenticate with Doppler: %v", err)
+		return SecretSyncResult{}, fmt.Errorf("Failed to get auth provider: %w", err)
+	}
+
+	apiContext, err := authProvider.GetAPIContext(ctx)
+	if err != nil {
+		r.recordSyncEvent(&dopplerSecret, existingKubeSecret, corev1.EventTypeWarning, eventReasonAuthFailed, "Unable to authenticate with Doppler: %v", err)
+		return SecretSyncResult{}, fmt.Errorf("Failed to get API context: %w", err)
 	}
 
 	currentProcessorsVersion, err := GetProcessorsVersion(dopplerSecret.Spec.Processors)
 	if err != nil {
-		return fmt.Errorf("Failed to compute processors version: %w", err)
+		return SecretSyncResult{}, fmt.Errorf("Failed to compute processors version: %w", err)
 	}
 
 	log.Info("Fetching Doppler secrets")
@@ -280,23 +519,36 @@ func (r *DopplerSecretReconciler) UpdateSecret(ctx context.Context, dopplerSecre
 	processorsVersion := ""
 	formatVersion := ""
 	existingLabels := map[string]string{}
-	existingCustomAnnotations := map[string]string{}
+	existingAnnotations := map[string]string{}
+	appliedFields := ManagedSecretFields{Labels: sets.New[string](), Annotations: sets.New[string]()}
+	changes := []string{}
 	if existingKubeSecret != nil {
 		secretVersion = existingKubeSecret.Annotations[kubeSecretVersionAnnotation]
 		processorsVersion = existingKubeSecret.Annotations[kubeSecretProcessorsVersionAnnotation]
 		formatVersion = existingKubeSecret.Annotations[kubeSecretFormatVersionAnnotation]
 		existingLabels = existingKubeSecret.Labels
-		// We can't predict the new annotations because it includes the latest secret version.
-		// Instead, we'll just compare the custom (non-builtin) annotations on the secret against the spec.
-		for k, v := range existingKubeSecret.Annotations {
-			if !slices.Contains(kubeSecretBuiltInAnnotationKeys, k) {
-				existingCustomAnnotations[k] = v
+		existingAnnotations = existingKubeSecret.Annotations
+
+		// Secrets written by earlier versions of the operator need to be applied once so the operator owns its fields
+		var applied bool
+		appliedFields, applied = GetManagedSecretFields(*existingKubeSecret)
+		if !applied {
+			changes = append(changes, "fieldManager")
+		}
+
+		// The key hashes annotation records the data the operator last wrote. If the data no longer matches, the secret was modified outside of the operator.
+		// Keys added by others are left alone.
+		if keyHashes, ok := ParseKeyHashesAnnotation(*existingKubeSecret); ok {
+			existingKeyHashes := GetKeyHashes(existingKubeSecret.Data, existingKubeSecret.Annotations[kubeSecretKeyHashesSaltAnnotation])
+			for k, hash := range keyHashes {
+				if existingKeyHashes[k] != hash {
+					changes = append(changes, "data")
+					break
+				}
 			}
 		}
 	}
 
-	changes := []string{}
-
 	// Processors transform secret values so if they've changed, we need to re-fetch the secrets so they can be re-processed.
 	if currentProcessorsVersion != processorsVersion {
 		changes = append(changes, "processors")
@@ -309,43 +561,97 @@ func (r *DopplerSecretReconciler) UpdateSecret(ctx context.Context, dopplerSecre
 		changes = append(changes, "format")
 	}
 
-	// If the labels have been changed, we don't technically need to reload the secrets but it's simpler to do.
-	if !reflect.DeepEqual(existingLabels, GetKubeSecretLabels(dopplerSecret.Spec.ManagedSecretRef.Labels)) {
+	// Only the labels and annotations applied by the operator are compared, so those added by others don't trigger a reload.
+	// If they've been changed, we don't technically need to reload the secrets but it's simpler to do.
+	if hasAppliedKeysChanged(existingLabels, GetKubeSecretLabels(dopplerSecret.Spec.ManagedSecretRef.Labels, getDeletionPolicy(dopplerSecret)), appliedFields.Labels) {
 		changes = append(changes, "labels")
 	}
 
-	customAnnotations := dopplerSecret.Spec.ManagedSecretRef.Annotations
-	if customAnnotations == nil {
-		// Default to empty for comparison
-		customAnnotations = map[string]string{}
-	}
-
-	// If the annotations have been changed, we don't technically need to reload the secrets but it's simpler to do.
-	if !reflect.DeepEqual(existingCustomAnnotations, customAnnotations) {
+	// We can't predict the new annotations because it includes the latest secret version.
+	// Instead, we'll just compare the custom (non-builtin) annotations on the secret against the spec.
+	appliedCustomAnnotations := appliedFields.Annotations.Clone().Delete(kubeSecretBuiltInAnnotationKeys...)
+	if hasAppliedKeysChanged(existingAnnotations, dopplerSecret.Spec.ManagedSecretRef.Annotations, appliedCustomAnnotations) {
 		changes = append(changes, "annotations")
 	}
 
 	// If any relevant attributes have been changed, set requestedSecretVersion to an empty secret version to reload the secrets.
 	requestedSecretVersion := secretVersion
-	if len(changes) > 0 {
+	held := dopplerSecret.Status.Rollback != nil && existingKubeSecret != nil
+	if held {
+		// The managed secret was rolled back after a failed rollout. Hold it until the Doppler secrets move past the failed version,
+		// even if other attributes have changed, so the failed version isn't re-applied.
+		requestedSecretVersion = dopplerSecret.Status.Rollback.FailedVersion
+	} else if len(changes) > 0 {
 		log.Info("[/] Attributes have changed, reloading secrets.", "changes", changes)
 		requestedSecretVersion = ""
 	}
 
-	secretsResult, apiErr := api.GetSecrets(*apiContext, requestedSecretVersion, dopplerSecret.Spec.Project, dopplerSecret.Spec.Config, dopplerSecret.Spec.NameTransformer, dopplerSecret.Spec.Format, dopplerSecret.Spec.Secrets)
+	secretsResult, apiErr := api.GetSecrets(ctx, *apiContext, requestedSecretVersion, dopplerSecret.Spec.Project, dopplerSecret.Spec.Config, dopplerSecret.Spec.NameTransformer, dopplerSecret.Spec.Format, dopplerSecret.Spec.Secrets)
 	if apiErr != nil {
-		return apiErr
+		if apiErr.Class == api.ErrorClassUnauthorized || apiErr.Class == api.ErrorClassForbidden {
+			r.recordSyncEvent(&dopplerSecret, existingKubeSecret, corev1.EventTypeWarning, eventReasonAuthFailed, "Doppler rejected the token: %v", apiErr)
+		}
+		return SecretSyncResult{}, apiErr
 	}
 	if !secretsResult.Modified {
+		if held {
+			if len(changes) > 0 {
+				// Apply the changes to the rolled back payload rather than the failed version
+				return r.reapplyRolledBackSecret(ctx, dopplerSecret, existingKubeSecret, changes)
+			}
+			log.Info("[-] Doppler secrets still match the rolled back version, holding.", "failedVersion", requestedSecretVersion)
+			return getSecretSyncResult(*existingKubeSecret), nil
+		}
 		log.Info("[-] Doppler secrets not modified.")
-		return nil
+		return getSecretSyncResult(*existingKubeSecret), nil
 	}
 
 	log.Info("[/] Secrets have been modified", "oldVersion", secretVersion, "newVersion", secretsResult.ETag, "changes", changes)
 
+	var newKubeSecret *corev1.Secret
 	if existingKubeSecret == nil {
-		return r.CreateManagedSecret(ctx, dopplerSecret, *secretsResult)
+		newKubeSecret, err = r.CreateManagedSecret(ctx, dopplerSecret, *secretsResult)
 	} else {
-		return r.UpdateManagedSecret(ctx, *existingKubeSecret, dopplerSecret, *secretsResult)
+		newKubeSecret, err = r.UpdateManagedSecret(ctx, *existingKubeSecret, dopplerSecret, *secretsResult)
+	}
+	if err != nil {
+		return SecretSyncResult{}, err
+	}
+	result := getSecretSyncResult(*newKubeSecret)
+	result.Project, result.Config = GetProjectAndConfig(secretsResult.Secrets)
+	if slices.Contains(changes, "data") {
+		log.Info("[/] Corrected drift in managed secret data")
+		r.recordSyncEvent(&dopplerSecret, existingKubeSecret, corev1.EventTypeWarning, eventReasonDriftCorrected, "Managed secret %s was modified outside of the operator and has been restored", managedSecretNamespacedName)
+	} else if existingKubeSecret == nil && isManagedSecretSynced(dopplerSecret, managedSecretNamespacedName) {
+		log.Info("[/] Recreated deleted managed secret")
+		r.recordSyncEvent(&dopplerSecret, newKubeSecret, corev1.EventTypeWarning, eventReasonDriftCorrected, "Managed secret %s was deleted outside of the operator and has been recreated", managedSecretNamespacedName)
+	}
+	return result, nil
+}
+
+// Evaluates whether the DopplerSecret has previously synced the managed secret, in which case a missing secret must have been deleted
+func isManagedSecretSynced(dopplerSecret secretsv1alpha1.DopplerSecret, managedSecret types.NamespacedName) bool {
+	synced := dopplerSecret.Status.ManagedSecret
+	return synced != nil && synced.Name == managedSecret.Name && synced.Namespace == managedSecret.Namespace
+}
+
+// Rebuilds a managed secret whose attributes changed, or whose data was modified, while syncing is held after a rollback
+func (r *DopplerSecretReconciler) reapplyRolledBackSecret(ctx context.Context, dopplerSecret secretsv1alpha1.DopplerSecret, managedSecret *corev1.Secret, changes []string) (SecretSyncResult, error) {
+	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName())
+	previousSecret, err := r.GetReferencedSecret(ctx, types.NamespacedName{
+		Name:      GetPreviousSecretName(managedSecret.Name),
+		Namespace: managedSecret.Namespace,
+	})
+	if err != nil {
+		return SecretSyncResult{}, fmt.Errorf("Unable to fetch previous secret: %w", err)
+	}
+	restoredSecret, err := r.restorePreviousSecret(ctx, dopplerSecret, managedSecret, previousSecret)
+	if err != nil {
+		return SecretSyncResult{}, err
+	}
+	log.Info("[/] Reapplied rolled back managed secret", "changes", changes)
+	if slices.Contains(changes, "data") {
+		r.recordSyncEvent(&dopplerSecret, managedSecret, corev1.EventTypeWarning, eventReasonDriftCorrected, "Managed secret %s/%s was modified outside of the operator and has been restored", managedSecret.Namespace, managedSecret.Name)
 	}
+	return getSecretSyncResult(*restoredSecret), nil
 }
@@ -0,0 +1,180 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestGetKeyDiff(t *testing.T) {
+	existing := map[string][]byte{
+		"API_KEY":  []byte("old"),
+		"DB_URL":   []byte("postgres://"),
+		"STALE":    []byte("stale"),
+		"EXTERNAL": []byte("set by another controller"),
+	}
+	previousKeys := sets.New("API_KEY", "DB_URL", "STALE")
+	data := map[string][]byte{
+		"API_KEY": []byte("new"),
+		"DB_URL":  []byte("postgres://"),
+		"PORT":    []byte("8080"),
+	}
+
+	diff := GetKeyDiff(existing, previousKeys, data)
+	expected := KeyDiff{Added: []string{"PORT"}, Removed: []string{"STALE"}, Changed: []string{"API_KEY"}}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected %+v, got %+v", expected, diff)
+	}
+	if diff.String() != "Added: PORT. Removed: STALE. Changed: API_KEY." {
+		t.Errorf("unexpected message %q", diff.String())
+	}
+	if !GetKeyDiff(existing, previousKeys, map[string][]byte{"API_KEY": []byte("old"), "DB_URL": []byte("postgres://"), "STALE": []byte("stale")}).IsEmpty() {
+		t.Error("expected no changes")
+	}
+}
+
+func TestGetKeyHashes(t *testing.T) {
+	data := map[string][]byte{"PIN": []byte("1234")}
+
+	salt, err := NewKeyHashesSalt()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	otherSalt, err := NewKeyHashesSalt()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if salt == otherSalt {
+		t.Fatalf("expected each salt to be random, got %s twice", salt)
+	}
+
+	hash := GetKeyHashes(data, salt)["PIN"]
+	if again := GetKeyHashes(data, salt)["PIN"]; again != hash {
+		t.Errorf("expected the same salt to produce the same hash, got %s and %s", hash, again)
+	}
+	if other := GetKeyHashes(data, otherSalt)["PIN"]; other == hash {
+		t.Errorf("expected different salts to produce different hashes")
+	}
+}
+
+func TestCheckManagedSecretOwnership(t *testing.T) {
+	dopplerSecret := newTestDopplerSecret("default", "app", "", "app-secret")
+	tests := []struct {
+		name              string
+		annotations       map[string]string
+		labels            map[string]string
+		expectedManagedBy string
+		expectConflict    bool
+	}{
+		{
+			name:           "unowned secret",
+			expectConflict: true,
+		},
+		{
+			name:           "unowned secret with unrelated annotations",
+			annotations:    map[string]string{"example.com/owner": "someone"},
+			expectConflict: true,
+		},
+		{
+			name:              "secret owned by another DopplerSecret",
+			annotations:       map[string]string{kubeSecretManagedByAnnotation: "default/other"},
+			labels:            map[string]string{kubeSecretSubtypeLabel: "dopplerSecret"},
+			expectedManagedBy: "default/other",
+			expectConflict:    true,
+		},
+		{
+			name:              "secret owned by a DopplerSecret with the same name in another namespace",
+			annotations:       map[string]string{kubeSecretManagedByAnnotation: "production/app"},
+			expectedManagedBy: "production/app",
+			expectConflict:    true,
+		},
+		{
+			name:        "secret owned by this DopplerSecret",
+			annotations: map[string]string{kubeSecretManagedByAnnotation: "default/app"},
+			labels:      map[string]string{kubeSecretSubtypeLabel: "dopplerSecret"},
+		},
+		{
+			name:   "secret created by an older version of the operator",
+			labels: map[string]string{kubeSecretSubtypeLabel: "dopplerSecret"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "app-secret",
+				Annotations: test.annotations,
+				Labels:      test.labels,
+			}}
+			err := checkManagedSecretOwnership(secret, *dopplerSecret)
+			if !test.expectConflict {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			var ownershipConflict *OwnershipConflictError
+			if !errors.As(err, &ownershipConflict) {
+				t.Fatalf("expected an ownership conflict, got %v", err)
+			}
+			if ownershipConflict.Secret != "default/app-secret" || ownershipConflict.ManagedBy != test.expectedManagedBy {
+				t.Errorf("expected a conflict for default/app-secret managed by %q, got %+v", test.expectedManagedBy, ownershipConflict)
+			}
+		})
+	}
+}
+
+func TestUpdateSecretDoesNotOverwriteUnownedSecret(t *testing.T) {
+	ctx := context.Background()
+	r, dopplerAPI, dopplerSecret := newTestRollbackReconciler(t)
+	dopplerAPI.setSecrets("v1", map[string]string{"API_KEY": "doppler"})
+	existing := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "managed"},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{"API_KEY": []byte("someone else's")},
+	}
+	if err := r.Client.Create(ctx, existing); err != nil {
+		t.Fatalf("unable to create secret: %v", err)
+	}
+
+	_, err := r.UpdateSecret(ctx, *dopplerSecret)
+	var ownershipConflict *OwnershipConflictError
+	if !errors.As(err, &ownershipConflict) {
+		t.Fatalf("expected an ownership conflict, got %v", err)
+	}
+	if data := getTestSecret(t, r, "managed").Data; !reflect.DeepEqual(data, existing.Data) {
+		t.Errorf("expected the unowned secret to be left alone, got %v", data)
+	}
+
+	// Adopting the secret takes it over
+	dopplerSecret.Spec.ManagedSecretRef.Adopt = true
+	if _, err := r.UpdateSecret(ctx, *dopplerSecret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	managedSecret := getTestSecret(t, r, "managed")
+	if !reflect.DeepEqual(managedSecret.Data, map[string][]byte{"API_KEY": []byte("doppler")}) || managedSecret.Annotations[kubeSecretManagedByAnnotation] != "default/dopplersecret" {
+		t.Errorf("expected the adopted secret to be synced, got %v %v", managedSecret.Annotations, managedSecret.Data)
+	}
+}
@@ -0,0 +1,385 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func findWorkloadKind(t *testing.T, kinds []WorkloadKind, kind string) *WorkloadKind {
+	t.Helper()
+	for i := range kinds {
+		if kinds[i].GroupVersionKind.Kind == kind {
+			return &kinds[i]
+		}
+	}
+	t.Fatalf("workload kind %s not found", kind)
+	return nil
+}
+
+func TestDefaultWorkloadKinds(t *testing.T) {
+	tests := []struct {
+		kind     string
+		obj      client.Object
+		template func(obj client.Object) *corev1.PodTemplateSpec
+		selector func(obj client.Object) *metav1.LabelSelector
+		list     client.ObjectList
+	}{
+		{
+			kind:     "Deployment",
+			obj:      &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}}},
+			template: func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.Deployment).Spec.Template },
+			selector: func(obj client.Object) *metav1.LabelSelector { return obj.(*appsv1.Deployment).Spec.Selector },
+			list:     &appsv1.DeploymentList{},
+		},
+		{
+			kind:     "StatefulSet",
+			obj:      &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}}},
+			template: func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.StatefulSet).Spec.Template },
+			selector: func(obj client.Object) *metav1.LabelSelector { return obj.(*appsv1.StatefulSet).Spec.Selector },
+			list:     &appsv1.StatefulSetList{},
+		},
+		{
+			kind:     "DaemonSet",
+			obj:      &appsv1.DaemonSet{Spec: appsv1.DaemonSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}}},
+			template: func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.DaemonSet).Spec.Template },
+			selector: func(obj client.Object) *metav1.LabelSelector { return obj.(*appsv1.DaemonSet).Spec.Selector },
+			list:     &appsv1.DaemonSetList{},
+		},
+		{
+			kind:     "ReplicaSet",
+			obj:      &appsv1.ReplicaSet{Spec: appsv1.ReplicaSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}}},
+			template: func(obj client.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.ReplicaSet).Spec.Template },
+			selector: func(obj client.Object) *metav1.LabelSelector { return obj.(*appsv1.ReplicaSet).Spec.Selector },
+			list:     &appsv1.ReplicaSetList{},
+		},
+		{
+			kind: "CronJob",
+			obj:  &batchv1.CronJob{},
+			template: func(obj client.Object) *corev1.PodTemplateSpec {
+				return &obj.(*batchv1.CronJob).Spec.JobTemplate.Spec.Template
+			},
+			// The pods of a CronJob are selected by its jobs
+			selector: func(obj client.Object) *metav1.LabelSelector { return nil },
+			list:     &batchv1.CronJobList{},
+		},
+	}
+
+	if len(DefaultWorkloadKinds) != len(tests) {
+		t.Fatalf("expected %d default workload kinds, got %d", len(tests), len(DefaultWorkloadKinds))
+	}
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+			kind := findWorkloadKind(t, DefaultWorkloadKinds, test.kind)
+			if reflect.TypeOf(kind.NewList()) != reflect.TypeOf(test.list) {
+				t.Errorf("expected list of type %T, got %T", test.list, kind.NewList())
+			}
+
+			annotations := map[string]string{"example.com/key": "value"}
+			if err := kind.SetPodTemplateAnnotations(test.obj, annotations); err != nil {
+				t.Fatalf("unable to set pod template annotations: %v", err)
+			}
+			if !reflect.DeepEqual(test.template(test.obj).Annotations, annotations) {
+				t.Errorf("expected annotations to be set on the embedded pod template, got %v", test.template(test.obj).Annotations)
+			}
+			template, err := kind.GetPodTemplate(test.obj)
+			if err != nil {
+				t.Fatalf("unable to read pod template: %v", err)
+			}
+			if template != test.template(test.obj) {
+				t.Errorf("expected the embedded pod template to be returned")
+			}
+
+			if _, err := kind.GetPodTemplate(&corev1.Pod{}); err == nil {
+				t.Errorf("expected an error reading the pod template of another type")
+			}
+
+			selector, err := kind.GetSelector(test.obj)
+			if err != nil {
+				t.Fatalf("unable to read selector: %v", err)
+			}
+			if selector != test.selector(test.obj) {
+				t.Errorf("expected the workload's selector to be returned, got %v", selector)
+			}
+		})
+	}
+}
+
+func TestIsControlledByWorkload(t *testing.T) {
+	tests := []struct {
+		name     string
+		owner    *metav1.OwnerReference
+		expected bool
+	}{
+		{
+			name:     "no owner",
+			expected: false,
+		},
+		{
+			name:     "controlled by a Deployment",
+			owner:    &metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Controller: boolPtr(true)},
+			expected: true,
+		},
+		{
+			name:     "controlled by an unknown kind",
+			owner:    &metav1.OwnerReference{APIVersion: "argoproj.io/v1alpha1", Kind: "Rollout", Name: "web", Controller: boolPtr(true)},
+			expected: false,
+		},
+		{
+			name:     "controlled by a kind with the same name in another group",
+			owner:    &metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Deployment", Name: "web", Controller: boolPtr(true)},
+			expected: false,
+		},
+		{
+			name:     "owned by a Deployment without being controlled",
+			owner:    &metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"},
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replicaSet := &appsv1.ReplicaSet{}
+			if test.owner != nil {
+				replicaSet.OwnerReferences = []metav1.OwnerReference{*test.owner}
+			}
+			if actual := isControlledByWorkload(replicaSet, DefaultWorkloadKinds); actual != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseWorkloadKind(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		expectedGVK  schema.GroupVersionKind
+		expectedPath []string
+		// Where the pod selector is expected, next to the pod template
+		expectedSelectorPath []string
+		expectError          bool
+	}{
+		{
+			name:                 "group, version and kind",
+			value:                "argoproj.io/v1alpha1/Rollout=spec.template",
+			expectedGVK:          schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"},
+			expectedPath:         []string{"spec", "template"},
+			expectedSelectorPath: []string{"spec", "selector"},
+		},
+		{
+			name:                 "core group",
+			value:                "v1/PodTemplate=template",
+			expectedGVK:          schema.GroupVersionKind{Version: "v1", Kind: "PodTemplate"},
+			expectedPath:         []string{"template"},
+			expectedSelectorPath: []string{"selector"},
+		},
+		{
+			name:                 "surrounding whitespace",
+			value:                " argoproj.io/v1alpha1/Rollout=spec.template ",
+			expectedGVK:          schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"},
+			expectedPath:         []string{"spec", "template"},
+			expectedSelectorPath: []string{"spec", "selector"},
+		},
+		{
+			name:        "kind.version.group format",
+			value:       "Rollout.v1alpha1.argoproj.io=spec.template",
+			expectError: true,
+		},
+		{
+			name:        "missing pod template path",
+			value:       "argoproj.io/v1alpha1/Rollout",
+			expectError: true,
+		},
+		{
+			name:        "empty pod template path",
+			value:       "argoproj.io/v1alpha1/Rollout=",
+			expectError: true,
+		},
+		{
+			name:        "empty pod template path segment",
+			value:       "argoproj.io/v1alpha1/Rollout=spec..template",
+			expectError: true,
+		},
+		{
+			name:        "missing kind",
+			value:       "argoproj.io/v1alpha1/=spec.template",
+			expectError: true,
+		},
+		{
+			name:        "missing version",
+			value:       "argoproj.io//Rollout=spec.template",
+			expectError: true,
+		},
+		{
+			name:        "too many parts",
+			value:       "argoproj.io/v1alpha1/Rollout/status=spec.template",
+			expectError: true,
+		},
+		{
+			name:        "empty",
+			value:       "",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kind, err := ParseWorkloadKind(test.value)
+			if test.expectError {
+				if err == nil {
+					t.Fatalf("expected an error, got workload kind %s", kind.GroupVersionKind.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if kind.GroupVersionKind != test.expectedGVK {
+				t.Errorf("expected %s, got %s", test.expectedGVK.String(), kind.GroupVersionKind.String())
+			}
+			list := kind.NewList().(*unstructured.UnstructuredList)
+			if list.GroupVersionKind() != test.expectedGVK.GroupVersion().WithKind(test.expectedGVK.Kind+"List") {
+				t.Errorf("expected list kind %sList, got %s", test.expectedGVK.Kind, list.GroupVersionKind().String())
+			}
+
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			obj.SetGroupVersionKind(test.expectedGVK)
+			err = unstructured.SetNestedField(obj.Object, map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "test"}},
+			}, test.expectedPath...)
+			if err != nil {
+				t.Fatalf("unable to set pod template: %v", err)
+			}
+			template, err := kind.GetPodTemplate(obj)
+			if err != nil {
+				t.Fatalf("unable to read pod template at %v: %v", test.expectedPath, err)
+			}
+			if template.Labels["app"] != "test" {
+				t.Errorf("expected pod template labels to be read from %v, got %v", test.expectedPath, template.Labels)
+			}
+
+			annotations := map[string]string{"example.com/key": "value"}
+			if err := kind.SetPodTemplateAnnotations(obj, annotations); err != nil {
+				t.Fatalf("unable to set pod template annotations: %v", err)
+			}
+			template, err = kind.GetPodTemplate(obj)
+			if err != nil {
+				t.Fatalf("unable to read pod template at %v: %v", test.expectedPath, err)
+			}
+			if !reflect.DeepEqual(template.Annotations, annotations) || template.Labels["app"] != "test" {
+				t.Errorf("expected annotations to be set on the pod template at %v, got %v", test.expectedPath, template.ObjectMeta)
+			}
+
+			selector, err := kind.GetSelector(obj)
+			if err != nil || selector != nil {
+				t.Errorf("expected no selector before it's set, got %v %v", selector, err)
+			}
+			err = unstructured.SetNestedField(obj.Object, map[string]interface{}{
+				"matchLabels": map[string]interface{}{"app": "test"},
+			}, test.expectedSelectorPath...)
+			if err != nil {
+				t.Fatalf("unable to set selector: %v", err)
+			}
+			selector, err = kind.GetSelector(obj)
+			if err != nil {
+				t.Fatalf("unable to read selector at %v: %v", test.expectedSelectorPath, err)
+			}
+			if selector == nil || !reflect.DeepEqual(selector.MatchLabels, map[string]string{"app": "test"}) {
+				t.Errorf("expected the selector to be read from %v, got %v", test.expectedSelectorPath, selector)
+			}
+		})
+	}
+}
+
+func TestParseWorkloadKinds(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		expected    []schema.GroupVersionKind
+		expectError bool
+	}{
+		{
+			name:     "empty",
+			value:    "",
+			expected: []schema.GroupVersionKind{},
+		},
+		{
+			name:  "multiple kinds",
+			value: "argoproj.io/v1alpha1/Rollout=spec.template, v1/PodTemplate=template",
+			expected: []schema.GroupVersionKind{
+				{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"},
+				{Version: "v1", Kind: "PodTemplate"},
+			},
+		},
+		{
+			name:     "empty entries are ignored",
+			value:    ",argoproj.io/v1alpha1/Rollout=spec.template,,",
+			expected: []schema.GroupVersionKind{{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}},
+		},
+		{
+			name:        "duplicate kind",
+			value:       "argoproj.io/v1alpha1/Rollout=spec.template,argoproj.io/v1alpha1/Rollout=spec.template",
+			expectError: true,
+		},
+		{
+			name:        "duplicate of a default kind",
+			value:       "apps/v1/Deployment=spec.template",
+			expectError: true,
+		},
+		{
+			name:        "malformed kind",
+			value:       "argoproj.io/v1alpha1/Rollout=spec.template,Rollout.v1alpha1.argoproj.io=spec.template",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kinds, err := ParseWorkloadKinds(test.value)
+			if test.expectError {
+				if err == nil {
+					t.Fatalf("expected an error, got %d workload kinds", len(kinds))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			gvks := []schema.GroupVersionKind{}
+			for _, kind := range kinds {
+				gvks = append(gvks, kind.GroupVersionKind)
+			}
+			if !reflect.DeepEqual(gvks, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, gvks)
+			}
+		})
+	}
+}
+
+func boolPtr(value bool) *bool {
+	return &value
+}
@@ -0,0 +1,904 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+const (
+	workloadSecretUpdateAnnotationPrefix = "secrets.doppler.com/secretsupdate"
+	workloadRestartAnnotation            = "secrets.doppler.com/reload"
+	workloadLastRestartAnnotation        = "secrets.doppler.com/last-restart"
+)
+
+// WorkloadKind describes a kind of workload which embeds a pod template and can be reloaded by the operator
+type WorkloadKind struct {
+	GroupVersionKind schema.GroupVersionKind
+
+	// Returns a new, empty object of this kind
+	NewObject func() client.Object
+
+	// Returns a new, empty list of this kind
+	NewList func() client.ObjectList
+
+	// Returns the pod template embedded in the workload
+	GetPodTemplate func(obj client.Object) (*corev1.PodTemplateSpec, error)
+
+	// Returns the label selector of the workload's pods, or nil if the workload doesn't select pods itself
+	GetSelector func(obj client.Object) (*metav1.LabelSelector, error)
+
+	// Replaces the annotations of the pod template embedded in the workload
+	SetPodTemplateAnnotations func(obj client.Object, annotations map[string]string) error
+
+	// Returns the state of the workload's most recent rollout
+	GetRolloutState func(obj client.Object) (RolloutState, error)
+
+	// If set, workloads of this kind are always restarted with this strategy, regardless of the configured strategy
+	RequiredRestartStrategy RestartStrategy
+}
+
+// Workload is a single object of a WorkloadKind
+type Workload struct {
+	Kind   *WorkloadKind
+	Object client.Object
+}
+
+func (w Workload) String() string {
+	return fmt.Sprintf("%s %s/%s", w.Kind.GroupVersionKind.Kind, w.Object.GetNamespace(), w.Object.GetName())
+}
+
+// newTypedWorkloadKind creates a WorkloadKind for a typed object whose pod template is returned by podTemplate
+func newTypedWorkloadKind[T client.Object](gvk schema.GroupVersionKind, newObject func() client.Object, newList func() client.ObjectList, podTemplate func(T) *corev1.PodTemplateSpec, selector func(T) *metav1.LabelSelector, rolloutState func(T) RolloutState) WorkloadKind {
+	getTemplate := func(obj client.Object) (*corev1.PodTemplateSpec, error) {
+		typed, ok := obj.(T)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected object type %T for %s", obj, gvk.Kind)
+		}
+		return podTemplate(typed), nil
+	}
+	return WorkloadKind{
+		GroupVersionKind: gvk,
+		NewObject:        newObject,
+		NewList:          newList,
+		GetPodTemplate:   getTemplate,
+		GetSelector: func(obj client.Object) (*metav1.LabelSelector, error) {
+			typed, ok := obj.(T)
+			if !ok {
+				return nil, fmt.Errorf("Unexpected object type %T for %s", obj, gvk.Kind)
+			}
+			return selector(typed), nil
+		},
+		SetPodTemplateAnnotations: func(obj client.Object, annotations map[string]string) error {
+			template, err := getTemplate(obj)
+			if err != nil {
+				return err
+			}
+			template.Annotations = annotations
+			return nil
+		},
+		GetRolloutState: func(obj client.Object) (RolloutState, error) {
+			typed, ok := obj.(T)
+			if !ok {
+				return "", fmt.Errorf("Unexpected object type %T for %s", obj, gvk.Kind)
+			}
+			return rolloutState(typed), nil
+		},
+	}
+}
+
+// withRequiredRestartStrategy returns the workload kind with its restart strategy fixed to strategy
+func withRequiredRestartStrategy(kind WorkloadKind, strategy RestartStrategy) WorkloadKind {
+	kind.RequiredRestartStrategy = strategy
+	return kind
+}
+
+// DefaultWorkloadKinds are the built-in workload kinds which the operator can reload
+var DefaultWorkloadKinds = []WorkloadKind{
+	newTypedWorkloadKind(appsv1.SchemeGroupVersion.WithKind("Deployment"),
+		func() client.Object { return &appsv1.Deployment{} },
+		func() client.ObjectList { return &appsv1.DeploymentList{} },
+		func(d *appsv1.Deployment) *corev1.PodTemplateSpec { return &d.Spec.Template },
+		func(d *appsv1.Deployment) *metav1.LabelSelector { return d.Spec.Selector },
+		getDeploymentRolloutState),
+	newTypedWorkloadKind(appsv1.SchemeGroupVersion.WithKind("StatefulSet"),
+		func() client.Object { return &appsv1.StatefulSet{} },
+		func() client.ObjectList { return &appsv1.StatefulSetList{} },
+		func(s *appsv1.StatefulSet) *corev1.PodTemplateSpec { return &s.Spec.Template },
+		func(s *appsv1.StatefulSet) *metav1.LabelSelector { return s.Spec.Selector },
+		getStatefulSetRolloutState),
+	newTypedWorkloadKind(appsv1.SchemeGroupVersion.WithKind("DaemonSet"),
+		func() client.Object { return &appsv1.DaemonSet{} },
+		func() client.ObjectList { return &appsv1.DaemonSetList{} },
+		func(d *appsv1.DaemonSet) *corev1.PodTemplateSpec { return &d.Spec.Template },
+		func(d *appsv1.DaemonSet) *metav1.LabelSelector { return d.Spec.Selector },
+		getDaemonSetRolloutState),
+	// ReplicaSets don't replace existing pods when their template changes, so their pods are always evicted
+	withRequiredRestartStrategy(newTypedWorkloadKind(appsv1.SchemeGroupVersion.WithKind("ReplicaSet"),
+		func() client.Object { return &appsv1.ReplicaSet{} },
+		func() client.ObjectList { return &appsv1.ReplicaSetList{} },
+		func(r *appsv1.ReplicaSet) *corev1.PodTemplateSpec { return &r.Spec.Template },
+		func(r *appsv1.ReplicaSet) *metav1.LabelSelector { return r.Spec.Selector },
+		getReplicaSetRolloutState), RestartStrategyEvict),
+	// CronJobs use the latest secrets from their next scheduled run, so their template is annotated rather than evicting the pods of running jobs
+	withRequiredRestartStrategy(newTypedWorkloadKind(batchv1.SchemeGroupVersion.WithKind("CronJob"),
+		func() client.Object { return &batchv1.CronJob{} },
+		func() client.ObjectList { return &batchv1.CronJobList{} },
+		func(c *batchv1.CronJob) *corev1.PodTemplateSpec { return &c.Spec.JobTemplate.Spec.Template },
+		// The pods of a CronJob are selected by the jobs it creates
+		func(c *batchv1.CronJob) *metav1.LabelSelector { return nil },
+		// CronJobs don't roll out, the template is used from the next scheduled run
+		func(c *batchv1.CronJob) RolloutState { return RolloutStateComplete }), RestartStrategyAnnotation),
+}
+
+// NewUnstructuredWorkloadKind creates a WorkloadKind for an arbitrary resource whose pod template is found at templatePath.
+// For example, an Argo Rollout embeds its pod template at `spec.template`. The pod selector is expected next to the template, e.g. at `spec.selector`.
+func NewUnstructuredWorkloadKind(gvk schema.GroupVersionKind, templatePath []string) WorkloadKind {
+	selectorPath := append(slices.Clone(templatePath[:len(templatePath)-1]), "selector")
+	return WorkloadKind{
+		GroupVersionKind: gvk,
+		NewObject: func() client.Object {
+			obj := &unstructured.Unstructured{}
+			obj.SetGroupVersionKind(gvk)
+			return obj
+		},
+		NewList: func() client.ObjectList {
+			list := &unstructured.UnstructuredList{}
+			list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+			return list
+		},
+		GetPodTemplate: func(obj client.Object) (*corev1.PodTemplateSpec, error) {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return nil, fmt.Errorf("Unexpected object type %T for %s", obj, gvk.Kind)
+			}
+			templateMap, found, err := unstructured.NestedMap(u.Object, templatePath...)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read pod template at %s: %w", strings.Join(templatePath, "."), err)
+			}
+			if !found {
+				return nil, fmt.Errorf("Pod template not found at %s", strings.Join(templatePath, "."))
+			}
+			template := &corev1.PodTemplateSpec{}
+			err = runtime.DefaultUnstructuredConverter.FromUnstructured(templateMap, template)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to convert pod template at %s: %w", strings.Join(templatePath, "."), err)
+			}
+			return template, nil
+		},
+		GetSelector: func(obj client.Object) (*metav1.LabelSelector, error) {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return nil, fmt.Errorf("Unexpected object type %T for %s", obj, gvk.Kind)
+			}
+			selectorMap, found, err := unstructured.NestedMap(u.Object, selectorPath...)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read pod selector at %s: %w", strings.Join(selectorPath, "."), err)
+			}
+			if !found {
+				return nil, nil
+			}
+			selector := &metav1.LabelSelector{}
+			err = runtime.DefaultUnstructuredConverter.FromUnstructured(selectorMap, selector)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to convert pod selector at %s: %w", strings.Join(selectorPath, "."), err)
+			}
+			return selector, nil
+		},
+		SetPodTemplateAnnotations: func(obj client.Object, annotations map[string]string) error {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return fmt.Errorf("Unexpected object type %T for %s", obj, gvk.Kind)
+			}
+			annotationsPath := append(append([]string{}, templatePath...), "metadata", "annotations")
+			return unstructured.SetNestedStringMap(u.Object, annotations, annotationsPath...)
+		},
+		GetRolloutState: func(obj client.Object) (RolloutState, error) {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return "", fmt.Errorf("Unexpected object type %T for %s", obj, gvk.Kind)
+			}
+			return getUnstructuredRolloutState(u), nil
+		},
+	}
+}
+
+// ParseWorkloadKind parses a workload kind in the format `<group>/<version>/<kind>=<pod template path>`,
+// e.g. `argoproj.io/v1alpha1/Rollout=spec.template`. The group is omitted for core resources, e.g. `v1/PodTemplate=template`.
+func ParseWorkloadKind(value string) (WorkloadKind, error) {
+	gvkValue, pathValue, found := strings.Cut(strings.TrimSpace(value), "=")
+	if !found || pathValue == "" {
+		return WorkloadKind{}, fmt.Errorf("Invalid workload kind %q, expected <group>/<version>/<kind>=<pod template path>", value)
+	}
+	parts := strings.Split(gvkValue, "/")
+	var gvk schema.GroupVersionKind
+	switch len(parts) {
+	case 2:
+		gvk = schema.GroupVersionKind{Version: parts[0], Kind: parts[1]}
+	case 3:
+		gvk = schema.GroupVersionKind{Group: parts[0], Version: parts[1], Kind: parts[2]}
+	default:
+		return WorkloadKind{}, fmt.Errorf("Invalid workload kind %q, expected <group>/<version>/<kind>=<pod template path>", value)
+	}
+	if gvk.Version == "" || gvk.Kind == "" {
+		return WorkloadKind{}, fmt.Errorf("Invalid workload kind %q, version and kind are required", value)
+	}
+	templatePath := strings.Split(pathValue, ".")
+	if slices.Contains(templatePath, "") {
+		return WorkloadKind{}, fmt.Errorf("Invalid pod template path %q for workload kind %q", pathValue, gvkValue)
+	}
+	return NewUnstructuredWorkloadKind(gvk, templatePath), nil
+}
+
+// ParseWorkloadKinds parses a comma-separated list of workload kinds. See ParseWorkloadKind for the format of each kind.
+func ParseWorkloadKinds(value string) ([]WorkloadKind, error) {
+	kinds := []WorkloadKind{}
+	for _, kindValue := range strings.Split(value, ",") {
+		if strings.TrimSpace(kindValue) == "" {
+			continue
+		}
+		kind, err := ParseWorkloadKind(kindValue)
+		if err != nil {
+			return nil, err
+		}
+		for _, existing := range slices.Concat(DefaultWorkloadKinds, kinds) {
+			if existing.GroupVersionKind == kind.GroupVersionKind {
+				return nil, fmt.Errorf("Workload kind %s is already registered", kind.GroupVersionKind.String())
+			}
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// getWorkloadKinds returns the workload kinds configured on the reconciler, falling back to the defaults
+func (r *DopplerSecretReconciler) getWorkloadKinds() []WorkloadKind {
+	if r.WorkloadKinds == nil {
+		return DefaultWorkloadKinds
+	}
+	return r.WorkloadKinds
+}
+
+// isControlledByWorkload returns true if the object is controlled by another reloadable workload.
+// For example, ReplicaSets created by a Deployment are reloaded through their Deployment.
+func isControlledByWorkload(obj client.Object, kinds []WorkloadKind) bool {
+	controller := metav1.GetControllerOf(obj)
+	return controller != nil && findControllerWorkloadKind(*controller, kinds) != nil
+}
+
+// findControllerWorkloadKind returns the workload kind of the controller reference, or nil if it isn't a configured kind
+func findControllerWorkloadKind(controller metav1.OwnerReference, kinds []WorkloadKind) *WorkloadKind {
+	for i := range kinds {
+		kind := &kinds[i]
+		if kind.GroupVersionKind.Kind == controller.Kind && kind.GroupVersionKind.GroupVersion().String() == controller.APIVersion {
+			return kind
+		}
+	}
+	return nil
+}
+
+// ListWorkloadsForDopplerSecret lists the workloads of every configured kind which use the DopplerSecret's managed secret
+// or are listed in its reload targets. Workloads are looked up with field indexes (see setupIndexes) rather than listing every workload.
+func (r *DopplerSecretReconciler) ListWorkloadsForDopplerSecret(ctx context.Context, dopplerSecret secretsv1alpha1.DopplerSecret) ([]Workload, error) {
+	managedSecret := getManagedSecretNamespacedName(dopplerSecret)
+	workloads, err := r.ListWorkloadsUsingSecret(ctx, managedSecret)
+	if err != nil {
+		return nil, err
+	}
+	kinds := r.getWorkloadKinds()
+	for i := range kinds {
+		kind := &kinds[i]
+		for _, target := range dopplerSecret.Spec.Reload.Targets {
+			if target.Kind != kind.GroupVersionKind.Kind || (target.APIVersion != "" && target.APIVersion != kind.GroupVersionKind.GroupVersion().String()) {
+				continue
+			}
+			obj := kind.NewObject()
+			err := r.Client.Get(ctx, types.NamespacedName{Namespace: managedSecret.Namespace, Name: target.Name}, obj)
+			if errors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to fetch reload target %s %s: %w", target.Kind, target.Name, err)
+			}
+			isListed := slices.ContainsFunc(workloads, func(workload Workload) bool {
+				return workload.Object.GetUID() == obj.GetUID()
+			})
+			if !isListed && !isControlledByWorkload(obj, kinds) {
+				workloads = append(workloads, Workload{Kind: kind, Object: obj})
+			}
+		}
+	}
+	return workloads, nil
+}
+
+// ListWorkloadsUsingSecret lists the workloads of every configured kind whose pod template uses the secret
+func (r *DopplerSecretReconciler) ListWorkloadsUsingSecret(ctx context.Context, secret types.NamespacedName) ([]Workload, error) {
+	kinds := r.getWorkloadKinds()
+	workloads := []Workload{}
+	for i := range kinds {
+		kind := &kinds[i]
+		list := kind.NewList()
+		err := r.Client.List(ctx, list, client.InNamespace(secret.Namespace), client.MatchingFields{workloadSecretNamesIndexField: secret.Name})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to fetch %s workloads: %w", kind.GroupVersionKind.Kind, err)
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read %s workloads: %w", kind.GroupVersionKind.Kind, err)
+		}
+		for _, item := range items {
+			obj, ok := item.(client.Object)
+			if !ok || isControlledByWorkload(obj, kinds) {
+				continue
+			}
+			workloads = append(workloads, Workload{Kind: kind, Object: obj})
+		}
+	}
+	return workloads, nil
+}
+
+// WorkloadReloadResult summarizes a pass over the workloads using a DopplerSecret
+type WorkloadReloadResult struct {
+	// The workloads which are reloaded when the managed secret changes
+	Workloads []secretsv1alpha1.WorkloadStatus
+
+	// The workloads whose rollout for the current secret version has failed
+	FailedWorkloads []string
+
+	// The number of workloads still waiting to be restarted
+	NumPending int
+
+	// If non-zero, the duration after which the pending workloads should be checked again
+	RequeueAfter time.Duration
+}
+
+// A workload which needs to be restarted to run the given secret version
+type pendingRestart struct {
+	workload      Workload
+	secretVersion string
+	strategy      RestartStrategy
+}
+
+// WorkloadReloadSource is why a workload is reloaded when the managed secret changes
+type WorkloadReloadSource string
+
+const (
+	// The workload has the reload annotation
+	WorkloadReloadSourceAnnotation WorkloadReloadSource = "Annotation"
+	// The workload matches the DopplerSecret's reload selector
+	WorkloadReloadSourceSelector WorkloadReloadSource = "Selector"
+	// The workload is listed in the DopplerSecret's reload targets
+	WorkloadReloadSourceTarget WorkloadReloadSource = "Target"
+)
+
+// Determines why a workload should be reloaded, returning an empty source if it shouldn't be.
+// Explicit targets take precedence over the selector, which takes precedence over the reload annotation.
+func getWorkloadReloadSource(workload Workload, reloadSpec secretsv1alpha1.ReloadSpec, selector labels.Selector) WorkloadReloadSource {
+	gvk := workload.Kind.GroupVersionKind
+	for _, target := range reloadSpec.Targets {
+		if target.Kind == gvk.Kind && target.Name == workload.Object.GetName() &&
+			(target.APIVersion == "" || target.APIVersion == gvk.GroupVersion().String()) {
+			return WorkloadReloadSourceTarget
+		}
+	}
+	if selector != nil && selector.Matches(labels.Set(workload.Object.GetLabels())) {
+		return WorkloadReloadSourceSelector
+	}
+	if workload.Object.GetAnnotations()[workloadRestartAnnotation] == "true" {
+		return WorkloadReloadSourceAnnotation
+	}
+	return ""
+}
+
+// Reconciles workloads that use the specified DopplerSecret and are marked with the restart annotation, match the reload selector
+// or are listed in the reload targets. Workloads are restarted in batches according to the DopplerSecret's reload configuration.
+func (r *DopplerSecretReconciler) ReconcileWorkloadsUsingSecret(ctx context.Context, dopplerSecret secretsv1alpha1.DopplerSecret) (WorkloadReloadResult, error) {
+	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName())
+	result := WorkloadReloadResult{}
+	kubeSecretNamespacedName := getManagedSecretNamespacedName(dopplerSecret)
+	namespace := kubeSecretNamespacedName.Namespace
+	workloads, err := r.ListWorkloadsForDopplerSecret(ctx, dopplerSecret)
+	if err != nil {
+		return result, err
+	}
+	kubeSecret := &corev1.Secret{}
+	err = r.Client.Get(ctx, kubeSecretNamespacedName, kubeSecret)
+	if err != nil {
+		return result, fmt.Errorf("Unable to fetch Kubernetes secret to update workloads: %w", err)
+	}
+
+	var selector labels.Selector
+	if dopplerSecret.Spec.Reload.Selector != nil {
+		selector, err = metav1.LabelSelectorAsSelector(dopplerSecret.Spec.Reload.Selector)
+		if err != nil {
+			return result, fmt.Errorf("Invalid reload selector: %w", err)
+		}
+	}
+
+	upToDate := []Workload{}
+	rollingOut := sets.New[string]()
+	pending := []pendingRestart{}
+	for _, workload := range workloads {
+		source := getWorkloadReloadSource(workload, dopplerSecret.Spec.Reload, selector)
+		if source == "" {
+			continue
+		}
+		template, err := workload.Kind.GetPodTemplate(workload.Object)
+		if err != nil {
+			log.Error(err, "Unable to read workload pod template", "workload", workload.String())
+			continue
+		}
+		usage := r.GetWorkloadSecretUsage(template, dopplerSecret)
+		if !usage.Used {
+			if source != WorkloadReloadSourceTarget {
+				continue
+			}
+			// Explicit targets may consume the secret in ways the operator can't detect, so reload them on any change
+			usage = SecretUsage{Used: true, AllKeys: true}
+		}
+		rolloutState, err := workload.Kind.GetRolloutState(workload.Object)
+		if err != nil {
+			log.Error(err, "Unable to read workload rollout state", "workload", workload.String())
+		}
+		gvk := workload.Kind.GroupVersionKind
+		result.Workloads = append(result.Workloads, secretsv1alpha1.WorkloadStatus{
+			APIVersion:      gvk.GroupVersion().String(),
+			Kind:            gvk.Kind,
+			Name:            workload.Object.GetName(),
+			Source:          string(source),
+			SecretVersion:   workload.Object.GetAnnotations()[getWorkloadSecretUpdateAnnotation(kubeSecret.Name)],
+			RolloutState:    string(rolloutState),
+			LastRestartTime: getWorkloadLastRestartTime(workload),
+		})
+
+		secretVersion := GetSecretVersionForUsage(*kubeSecret, usage)
+		strategy := r.getWorkloadRestartStrategy(workload, dopplerSecret)
+		if isWorkloadRunningSecretVersion(workload, template, kubeSecret.Name, secretVersion, strategy) {
+			upToDate = append(upToDate, workload)
+			switch rolloutState {
+			case RolloutStateFailed:
+				result.FailedWorkloads = append(result.FailedWorkloads, workload.String())
+			case RolloutStateProgressing:
+				// Check back soon to track the rollout's progress
+				result.RequeueAfter = rolloutProgressCheckInterval
+				if isHoldingRolloutSlot(workload) {
+					rollingOut.Insert(workload.String())
+				}
+			}
+		} else {
+			pending = append(pending, pendingRestart{workload: workload, secretVersion: secretVersion, strategy: strategy})
+		}
+	}
+	// Workloads restarted by the operator hold a slot against the concurrent restart limit until their rollout leaves Progressing
+	r.Rollouts.setInProgress(client.ObjectKeyFromObject(&dopplerSecret), rollingOut)
+	slices.SortFunc(result.Workloads, func(a, b secretsv1alpha1.WorkloadStatus) int {
+		return strings.Compare(a.Kind+"/"+a.Name, b.Kind+"/"+b.Name)
+	})
+	for _, target := range dopplerSecret.Spec.Reload.Targets {
+		found := slices.ContainsFunc(result.Workloads, func(workload secretsv1alpha1.WorkloadStatus) bool {
+			return workload.Kind == target.Kind && workload.Name == target.Name
+		})
+		if !found {
+			log.Info("[-] Reload target not found", "kind", target.Kind, "name", target.Name, "namespace", namespace)
+		}
+	}
+
+	if len(pending) == 0 {
+		r.Rollouts.clearLastBatchTime(client.ObjectKeyFromObject(&dopplerSecret))
+		log.Info("Finished reconciling workloads", "numWorkloads", len(result.Workloads))
+		return result, nil
+	}
+	result.NumPending = len(pending)
+
+	// Restart workloads in a stable order so batches progress predictably across reconciles
+	slices.SortFunc(pending, func(a, b pendingRestart) int {
+		return strings.Compare(a.workload.String(), b.workload.String())
+	})
+
+	reloadSpec := dopplerSecret.Spec.Reload
+	pending = r.deferPendingRestarts(dopplerSecret, kubeSecret, pending, &result)
+	if len(pending) == 0 {
+		return result, nil
+	}
+
+	if reloadSpec.WaitForAvailable {
+		if len(result.FailedWorkloads) > 0 {
+			// Don't roll out a change which has already broken a workload any further
+			log.Info("[-] Restarted workloads failed to roll out, holding remaining restarts", "failedWorkloads", result.FailedWorkloads, "numPending", len(pending))
+			result.RequeueAfter = rolloutProgressCheckInterval
+			return result, nil
+		}
+		for _, workload := range upToDate {
+			state, err := workload.Kind.GetRolloutState(workload.Object)
+			if err != nil {
+				continue
+			}
+			if state == RolloutStateProgressing {
+				log.Info("[-] Waiting for restarted workload to become available", "workload", workload.String(), "numPending", len(pending))
+				result.RequeueAfter = rolloutProgressCheckInterval
+				return result, nil
+			}
+		}
+	}
+
+	batchPause := time.Duration(reloadSpec.BatchPauseSeconds) * time.Second
+	if lastBatchTime, ok := r.Rollouts.getLastBatchTime(client.ObjectKeyFromObject(&dopplerSecret)); ok && time.Since(lastBatchTime) < batchPause {
+		result.RequeueAfter = batchPause - time.Since(lastBatchTime)
+		log.Info("[-] Waiting before restarting the next batch of workloads", "requeueAfter", result.RequeueAfter, "numPending", len(pending))
+		return result, nil
+	}
+
+	batch := pending
+	if reloadSpec.BatchSize > 0 && len(batch) > int(reloadSpec.BatchSize) {
+		batch = batch[:reloadSpec.BatchSize]
+	}
+	batchNames := []string{}
+	for _, restart := range batch {
+		batchNames = append(batchNames, restart.workload.String())
+	}
+	batch = batch[:len(r.Rollouts.reserve(client.ObjectKeyFromObject(&dopplerSecret), batchNames))]
+	if len(batch) == 0 {
+		log.Info("[-] Waiting for other workloads to finish rolling out before restarting", "numPending", len(pending))
+		result.RequeueAfter = rolloutProgressCheckInterval
+		return result, nil
+	}
+
+	var wg sync.WaitGroup
+	var restartedMu sync.Mutex
+	restarted := map[string]string{}
+	for _, restart := range batch {
+		wg.Add(1)
+		go func(restart pendingRestart, wg *sync.WaitGroup) {
+			defer wg.Done()
+			err := r.ReconcileWorkload(ctx, restart.workload, kubeSecret, restart.secretVersion, restart.strategy)
+			if err != nil {
+				// Errors reconciling workloads are logged but not propagated up. Failed workloads will be reconciled on the next run.
+				log.Error(err, "Unable to reconcile workload", "workload", restart.workload.String())
+				return
+			}
+			r.recordSyncEvent(&dopplerSecret, kubeSecret, corev1.EventTypeNormal, eventReasonWorkloadRestarted, "Restarted %s with the %s strategy to load secret version %s",
+				restart.workload.String(), restart.strategy, restart.secretVersion)
+			restartedMu.Lock()
+			defer restartedMu.Unlock()
+			restarted[restart.workload.Kind.GroupVersionKind.Kind+"/"+restart.workload.Object.GetName()] = restart.secretVersion
+		}(restart, &wg)
+	}
+	wg.Wait()
+	r.Rollouts.setLastBatchTime(client.ObjectKeyFromObject(&dopplerSecret), time.Now())
+
+	for i := range result.Workloads {
+		if secretVersion, ok := restarted[result.Workloads[i].Kind+"/"+result.Workloads[i].Name]; ok {
+			result.Workloads[i].SecretVersion = secretVersion
+			result.Workloads[i].RolloutState = string(RolloutStateProgressing)
+			result.Workloads[i].LastRestartTime = &metav1.Time{Time: time.Now()}
+		}
+	}
+
+	numDeferred := result.NumPending - len(pending)
+	result.NumPending -= len(batch)
+	if result.NumPending > numDeferred {
+		result.RequeueAfter = max(batchPause, minBatchRequeueDuration)
+		if reloadSpec.WaitForAvailable {
+			result.RequeueAfter = max(result.RequeueAfter, rolloutProgressCheckInterval)
+		}
+	} else if result.NumPending > 0 {
+		// Only deferred restarts remain, check back when the first is due or to track progress, whichever is sooner
+		result.RequeueAfter = min(result.RequeueAfter, rolloutProgressCheckInterval)
+	} else {
+		// Check back soon to track the progress of the restarted workloads
+		result.RequeueAfter = rolloutProgressCheckInterval
+	}
+
+	log.Info("Finished reconciling workloads", "numWorkloads", len(result.Workloads), "numRestarted", len(batch), "numPending", result.NumPending)
+
+	return result, nil
+}
+
+// Removes restarts which aren't due yet from the pending list according to the DopplerSecret's debounce window and minimum restart interval.
+// The scheduled time of each deferred restart is recorded in the result and the result is set to requeue when the first one is due.
+func (r *DopplerSecretReconciler) deferPendingRestarts(dopplerSecret secretsv1alpha1.DopplerSecret, kubeSecret *corev1.Secret, pending []pendingRestart, result *WorkloadReloadResult) []pendingRestart {
+	log := r.Log.WithValues("dopplersecret", dopplerSecret.GetNamespacedName())
+	reloadSpec := dopplerSecret.Spec.Reload
+	debounce := time.Duration(reloadSpec.DebounceSeconds) * time.Second
+	minRestartInterval := time.Duration(reloadSpec.MinRestartIntervalSeconds) * time.Second
+	if debounce == 0 && minRestartInterval == 0 {
+		return pending
+	}
+
+	// The last-updated annotation moves with every change to the managed secret, so changes within the window push the restart back
+	var debounceUntil time.Time
+	if debounce > 0 {
+		lastUpdated, err := time.Parse(time.RFC3339, kubeSecret.Annotations[kubeSecretLastUpdatedAnnotation])
+		if err == nil {
+			debounceUntil = lastUpdated.Add(debounce)
+		}
+	}
+
+	now := time.Now()
+	due := []pendingRestart{}
+	for _, restart := range pending {
+		restartAt := debounceUntil
+		if lastRestart := getWorkloadLastRestartTime(restart.workload); lastRestart != nil && minRestartInterval > 0 {
+			restartAt = latestTime(restartAt, lastRestart.Add(minRestartInterval))
+		}
+		if !restartAt.After(now) {
+			due = append(due, restart)
+			continue
+		}
+		for i := range result.Workloads {
+			if result.Workloads[i].Kind == restart.workload.Kind.GroupVersionKind.Kind && result.Workloads[i].Name == restart.workload.Object.GetName() {
+				result.Workloads[i].NextRestartTime = &metav1.Time{Time: restartAt}
+			}
+		}
+		if wait := restartAt.Sub(now); result.RequeueAfter == 0 || wait < result.RequeueAfter {
+			result.RequeueAfter = wait
+		}
+	}
+	if len(due) < len(pending) {
+		log.Info("[-] Deferring workload restarts", "numDeferred", len(pending)-len(due), "requeueAfter", result.RequeueAfter)
+	}
+	return due
+}
+
+func latestTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Evaluates whether a workload which is rolling out counts towards the concurrent restart limit.
+// Only workloads restarted by the operator within the maximum slot duration are counted.
+func isHoldingRolloutSlot(workload Workload) bool {
+	lastRestart := getWorkloadLastRestartTime(workload)
+	return lastRestart != nil && time.Since(lastRestart.Time) < maxRolloutSlotDuration
+}
+
+// Returns when the operator last restarted the workload, or nil if it hasn't
+func getWorkloadLastRestartTime(workload Workload) *metav1.Time {
+	lastRestart, err := time.Parse(time.RFC3339, workload.Object.GetAnnotations()[workloadLastRestartAnnotation])
+	if err != nil {
+		return nil
+	}
+	return &metav1.Time{Time: lastRestart}
+}
+
+// SecretUsage describes how a pod template consumes a managed secret
+type SecretUsage struct {
+	// Whether the pod template references the secret at all
+	Used bool
+
+	// Whether the pod template consumes every key in the secret, e.g. with `envFrom` or a volume
+	AllKeys bool
+
+	// The individual keys consumed by the pod template, e.g. with `secretKeyRef`
+	Keys []string
+}
+
+func (u *SecretUsage) addAllKeys() {
+	u.Used = true
+	u.AllKeys = true
+}
+
+func (u *SecretUsage) addKey(key string) {
+	u.Used = true
+	if !slices.Contains(u.Keys, key) {
+		u.Keys = append(u.Keys, key)
+	}
+}
+
+// Evaluates whether or not the pod template is using the specified DopplerSecret and which keys it consumes.
+func (r *DopplerSecretReconciler) GetWorkloadSecretUsage(template *corev1.PodTemplateSpec, dopplerSecret secretsv1alpha1.DopplerSecret) SecretUsage {
+	return GetPodSpecSecretUsage(&template.Spec, dopplerSecret.Spec.ManagedSecretRef.Name)
+}
+
+// Calls visit for every reference to a secret in the pod spec, with either the referenced key or allKeys set if the whole secret is used.
+// Secrets are referenced by containers, init containers or ephemeral containers using `envFrom` or `secretKeyRef`,
+// by `secret` or `projected` volumes and by `imagePullSecrets`.
+func visitPodSpecSecretRefs(podSpec *corev1.PodSpec, visit func(secretName string, key string, allKeys bool)) {
+	visitContainer := func(envFroms []corev1.EnvFromSource, envs []corev1.EnvVar) {
+		for _, envFrom := range envFroms {
+			if envFrom.SecretRef != nil {
+				visit(envFrom.SecretRef.LocalObjectReference.Name, "", true)
+			}
+		}
+		for _, env := range envs {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				visit(env.ValueFrom.SecretKeyRef.LocalObjectReference.Name, env.ValueFrom.SecretKeyRef.Key, false)
+			}
+		}
+	}
+	visitItems := func(secretName string, items []corev1.KeyToPath) {
+		if len(items) == 0 {
+			visit(secretName, "", true)
+		}
+		for _, item := range items {
+			visit(secretName, item.Key, false)
+		}
+	}
+
+	for _, container := range podSpec.InitContainers {
+		visitContainer(container.EnvFrom, container.Env)
+	}
+	for _, container := range podSpec.Containers {
+		visitContainer(container.EnvFrom, container.Env)
+	}
+	for _, container := range podSpec.EphemeralContainers {
+		visitContainer(container.EnvFrom, container.Env)
+	}
+	for _, volume := range podSpec.Volumes {
+		if volume.Secret != nil {
+			visitItems(volume.Secret.SecretName, volume.Secret.Items)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil {
+					visitItems(source.Secret.LocalObjectReference.Name, source.Secret.Items)
+				}
+			}
+		}
+	}
+	for _, imagePullSecret := range podSpec.ImagePullSecrets {
+		visit(imagePullSecret.Name, "", true)
+	}
+}
+
+// Evaluates whether or not the pod spec is using the named secret and which keys it consumes.
+// See visitPodSpecSecretRefs for the ways a pod spec can use a secret.
+func GetPodSpecSecretUsage(podSpec *corev1.PodSpec, secretName string) SecretUsage {
+	usage := SecretUsage{}
+	visitPodSpecSecretRefs(podSpec, func(name string, key string, allKeys bool) {
+		if name != secretName {
+			return
+		}
+		if allKeys {
+			usage.addAllKeys()
+		} else {
+			usage.addKey(key)
+		}
+	})
+	slices.Sort(usage.Keys)
+
+	return usage
+}
+
+// GetPodSpecSecretNames returns the sorted names of every secret the pod spec uses
+func GetPodSpecSecretNames(podSpec *corev1.PodSpec) []string {
+	names := []string{}
+	visitPodSpecSecretRefs(podSpec, func(name string, key string, allKeys bool) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	})
+	slices.Sort(names)
+	return names
+}
+
+// GetSecretVersionForUsage returns the version of the managed secret which a workload with the given usage should be running.
+// Workloads consuming the whole secret use the Doppler secrets version, so they are restarted whenever the secrets change.
+// Workloads consuming individual keys use a hash of those keys' salted hashes, so they are only restarted when one of their keys changes.
+// The salt isn't copied to workloads, so the values can't be guessed from the workload's annotations.
+func GetSecretVersionForUsage(secret corev1.Secret, usage SecretUsage) string {
+	secretVersion := secret.Annotations[kubeSecretVersionAnnotation]
+	if usage.AllKeys {
+		return secretVersion
+	}
+	keyHashes, ok := ParseKeyHashesAnnotation(secret)
+	if !ok {
+		// The secret was written by an older version of the operator, fall back to the secrets version
+		return secretVersion
+	}
+	hash := sha256.New()
+	for _, key := range usage.Keys {
+		// A missing key (e.g. an optional `secretKeyRef`) hashes as empty so it's restarted when the key is added
+		fmt.Fprintf(hash, "%s=%s\n", key, keyHashes[key])
+	}
+	return fmt.Sprintf("keys-%x", hash.Sum(nil))
+}
+
+// Returns the workload annotation which records the secret version a workload was last restarted for
+func getWorkloadSecretUpdateAnnotation(secretName string) string {
+	return fmt.Sprintf("%s.%s", workloadSecretUpdateAnnotationPrefix, secretName)
+}
+
+// Evaluates whether or not the workload has already been restarted for the secret version.
+// Only the annotation strategy records the version on the pod template, other strategies rely on the workload's own annotation.
+func isWorkloadRunningSecretVersion(workload Workload, template *corev1.PodTemplateSpec, secretName string, secretVersion string, strategy RestartStrategy) bool {
+	annotationKey := getWorkloadSecretUpdateAnnotation(secretName)
+	if workload.Object.GetAnnotations()[annotationKey] != secretVersion {
+		return false
+	}
+	return strategy != RestartStrategyAnnotation || template.Annotations[annotationKey] == secretVersion
+}
+
+// Reconciles a workload with a Kubernetes secret
+// Specifically, if the secret version is different from the workload's secret version annotation,
+// the workload is restarted using the given strategy and the annotation is updated.
+func (r *DopplerSecretReconciler) ReconcileWorkload(ctx context.Context, workload Workload, secret *corev1.Secret, secretVersion string, strategy RestartStrategy) error {
+	log := r.Log.WithValues("workload", workload.String(), "strategy", strategy)
+	template, err := workload.Kind.GetPodTemplate(workload.Object)
+	if err != nil {
+		return fmt.Errorf("Unable to read workload pod template: %w", err)
+	}
+	annotationKey := getWorkloadSecretUpdateAnnotation(secret.Name)
+	annotationValue := secretVersion
+	if isWorkloadRunningSecretVersion(workload, template, secret.Name, secretVersion, strategy) {
+		log.Info("[-] Workload is already running latest version, nothing to do")
+		return nil
+	}
+	now := time.Now().UTC()
+	switch strategy {
+	case RestartStrategyEvict:
+		// Pods created after the secret was last updated are already running the latest secrets
+		secretUpdatedAt, err := time.Parse(time.RFC3339, secret.Annotations[kubeSecretLastUpdatedAnnotation])
+		if err != nil {
+			secretUpdatedAt = now
+		}
+		if err := r.evictWorkloadPods(ctx, workload, secretUpdatedAt); err != nil {
+			return err
+		}
+	default:
+		templateAnnotations := template.Annotations
+		if templateAnnotations == nil {
+			templateAnnotations = make(map[string]string)
+		}
+		if strategy == RestartStrategyRestartedAt {
+			templateAnnotations[kubectlRestartedAtAnnotation] = now.Format(time.RFC3339)
+		} else {
+			templateAnnotations[annotationKey] = annotationValue
+		}
+		err = workload.Kind.SetPodTemplateAnnotations(workload.Object, templateAnnotations)
+		if err != nil {
+			return fmt.Errorf("Unable to set workload pod template annotation: %w", err)
+		}
+	}
+	annotations := workload.Object.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[annotationKey] = annotationValue
+	annotations[workloadLastRestartAnnotation] = now.Format(time.RFC3339)
+	workload.Object.SetAnnotations(annotations)
+	err = r.Client.Update(ctx, workload.Object)
+	if err != nil {
+		return fmt.Errorf("Failed to update workload annotation: %w", err)
+	}
+	log.Info("[/] Updated workload")
+	return nil
+}
@@ -0,0 +1,576 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+const testSecretName = "doppler-test-secret"
+
+func secretKeyRefEnv(secretName string, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: key,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+func secretEnvFrom(secretName string) corev1.EnvFromSource {
+	return corev1.EnvFromSource{
+		SecretRef: &corev1.SecretEnvSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+		},
+	}
+}
+
+func TestGetPodSpecSecretUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		podSpec  corev1.PodSpec
+		expected SecretUsage
+	}{
+		{
+			name:     "no references",
+			podSpec:  corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+			expected: SecretUsage{},
+		},
+		{
+			name: "container envFrom",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{{
+				EnvFrom: []corev1.EnvFromSource{secretEnvFrom(testSecretName)},
+			}}},
+			expected: SecretUsage{Used: true, AllKeys: true},
+		},
+		{
+			name: "container envFrom for another secret",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{{
+				EnvFrom: []corev1.EnvFromSource{secretEnvFrom("other-secret")},
+			}}},
+			expected: SecretUsage{},
+		},
+		{
+			name: "container secretKeyRef",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{{
+				Env: []corev1.EnvVar{
+					secretKeyRefEnv(testSecretName, "DATABASE_URL"),
+					secretKeyRefEnv(testSecretName, "API_KEY"),
+					secretKeyRefEnv("other-secret", "FEATURE_FLAG"),
+					{Name: "PLAIN", Value: "value"},
+				},
+			}}},
+			expected: SecretUsage{Used: true, Keys: []string{"API_KEY", "DATABASE_URL"}},
+		},
+		{
+			name: "duplicate secretKeyRef across containers",
+			podSpec: corev1.PodSpec{Containers: []corev1.Container{
+				{Env: []corev1.EnvVar{secretKeyRefEnv(testSecretName, "DATABASE_URL")}},
+				{Env: []corev1.EnvVar{secretKeyRefEnv(testSecretName, "DATABASE_URL")}},
+			}},
+			expected: SecretUsage{Used: true, Keys: []string{"DATABASE_URL"}},
+		},
+		{
+			name: "init container envFrom",
+			podSpec: corev1.PodSpec{InitContainers: []corev1.Container{{
+				EnvFrom: []corev1.EnvFromSource{secretEnvFrom(testSecretName)},
+			}}},
+			expected: SecretUsage{Used: true, AllKeys: true},
+		},
+		{
+			name: "init container secretKeyRef",
+			podSpec: corev1.PodSpec{InitContainers: []corev1.Container{{
+				Env: []corev1.EnvVar{secretKeyRefEnv(testSecretName, "MIGRATION_DATABASE_URL")},
+			}}},
+			expected: SecretUsage{Used: true, Keys: []string{"MIGRATION_DATABASE_URL"}},
+		},
+		{
+			name: "ephemeral container envFrom",
+			podSpec: corev1.PodSpec{EphemeralContainers: []corev1.EphemeralContainer{{
+				EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+					EnvFrom: []corev1.EnvFromSource{secretEnvFrom(testSecretName)},
+				},
+			}}},
+			expected: SecretUsage{Used: true, AllKeys: true},
+		},
+		{
+			name: "ephemeral container secretKeyRef",
+			podSpec: corev1.PodSpec{EphemeralContainers: []corev1.EphemeralContainer{{
+				EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+					Env: []corev1.EnvVar{secretKeyRefEnv(testSecretName, "DEBUG_TOKEN")},
+				},
+			}}},
+			expected: SecretUsage{Used: true, Keys: []string{"DEBUG_TOKEN"}},
+		},
+		{
+			name: "secret volume",
+			podSpec: corev1.PodSpec{Volumes: []corev1.Volume{{
+				Name: "secrets",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{SecretName: testSecretName},
+				},
+			}}},
+			expected: SecretUsage{Used: true, AllKeys: true},
+		},
+		{
+			name: "secret volume with items",
+			podSpec: corev1.PodSpec{Volumes: []corev1.Volume{{
+				Name: "secrets",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: testSecretName,
+						Items:      []corev1.KeyToPath{{Key: "DOPPLER_SECRETS_FILE", Path: "appsettings.json"}},
+					},
+				},
+			}}},
+			expected: SecretUsage{Used: true, Keys: []string{"DOPPLER_SECRETS_FILE"}},
+		},
+		{
+			name: "projected volume",
+			podSpec: corev1.PodSpec{Volumes: []corev1.Volume{{
+				Name: "projected",
+				VolumeSource: corev1.VolumeSource{
+					Projected: &corev1.ProjectedVolumeSource{
+						Sources: []corev1.VolumeProjection{
+							{ConfigMap: &corev1.ConfigMapProjection{LocalObjectReference: corev1.LocalObjectReference{Name: testSecretName}}},
+							{Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: testSecretName}}},
+						},
+					},
+				},
+			}}},
+			expected: SecretUsage{Used: true, AllKeys: true},
+		},
+		{
+			name: "projected volume with items",
+			podSpec: corev1.PodSpec{Volumes: []corev1.Volume{{
+				Name: "projected",
+				VolumeSource: corev1.VolumeSource{
+					Projected: &corev1.ProjectedVolumeSource{
+						Sources: []corev1.VolumeProjection{{
+							Secret: &corev1.SecretProjection{
+								LocalObjectReference: corev1.LocalObjectReference{Name: testSecretName},
+								Items:                []corev1.KeyToPath{{Key: "tls.crt", Path: "tls.crt"}, {Key: "tls.key", Path: "tls.key"}},
+							},
+						}},
+					},
+				},
+			}}},
+			expected: SecretUsage{Used: true, Keys: []string{"tls.crt", "tls.key"}},
+		},
+		{
+			name: "projected volume for another secret",
+			podSpec: corev1.PodSpec{Volumes: []corev1.Volume{{
+				Name: "projected",
+				VolumeSource: corev1.VolumeSource{
+					Projected: &corev1.ProjectedVolumeSource{
+						Sources: []corev1.VolumeProjection{{
+							Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "other-secret"}},
+						}},
+					},
+				},
+			}}},
+			expected: SecretUsage{},
+		},
+		{
+			name: "image pull secret",
+			podSpec: corev1.PodSpec{
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: testSecretName}},
+			},
+			expected: SecretUsage{Used: true, AllKeys: true},
+		},
+		{
+			name: "whole secret and individual keys",
+			podSpec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{
+					Env: []corev1.EnvVar{secretKeyRefEnv(testSecretName, "DATABASE_URL")},
+				}},
+				Containers: []corev1.Container{{
+					EnvFrom: []corev1.EnvFromSource{secretEnvFrom(testSecretName)},
+				}},
+			},
+			expected: SecretUsage{Used: true, AllKeys: true, Keys: []string{"DATABASE_URL"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usage := GetPodSpecSecretUsage(&test.podSpec, testSecretName)
+			if !reflect.DeepEqual(usage, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, usage)
+			}
+		})
+	}
+}
+
+func TestDeferPendingRestarts(t *testing.T) {
+	r := &DopplerSecretReconciler{Log: logr.Discard()}
+	now := time.Now()
+	newRestart := func(name string, lastRestart time.Time) pendingRestart {
+		annotations := map[string]string{}
+		if !lastRestart.IsZero() {
+			annotations[workloadLastRestartAnnotation] = lastRestart.UTC().Format(time.RFC3339)
+		}
+		return pendingRestart{workload: Workload{
+			Kind:   &DefaultWorkloadKinds[0],
+			Object: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations}},
+		}}
+	}
+	newSecret := func(lastUpdated time.Time) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			kubeSecretLastUpdatedAnnotation: lastUpdated.UTC().Format(time.RFC3339),
+		}}}
+	}
+
+	tests := []struct {
+		name            string
+		reload          secretsv1alpha1.ReloadSpec
+		secret          *corev1.Secret
+		pending         []pendingRestart
+		expectedDue     []string
+		expectedRequeue bool
+	}{
+		{
+			name:        "no debounce or interval",
+			secret:      newSecret(now),
+			pending:     []pendingRestart{newRestart("api", now)},
+			expectedDue: []string{"api"},
+		},
+		{
+			name:            "within debounce window",
+			reload:          secretsv1alpha1.ReloadSpec{DebounceSeconds: 60},
+			secret:          newSecret(now.Add(-30 * time.Second)),
+			pending:         []pendingRestart{newRestart("api", time.Time{}), newRestart("worker", time.Time{})},
+			expectedDue:     []string{},
+			expectedRequeue: true,
+		},
+		{
+			name:        "debounce window elapsed",
+			reload:      secretsv1alpha1.ReloadSpec{DebounceSeconds: 60},
+			secret:      newSecret(now.Add(-2 * time.Minute)),
+			pending:     []pendingRestart{newRestart("api", time.Time{})},
+			expectedDue: []string{"api"},
+		},
+		{
+			name:   "minimum restart interval",
+			reload: secretsv1alpha1.ReloadSpec{MinRestartIntervalSeconds: 600},
+			secret: newSecret(now.Add(-time.Hour)),
+			pending: []pendingRestart{
+				newRestart("api", now.Add(-5*time.Minute)),
+				newRestart("worker", now.Add(-15*time.Minute)),
+				newRestart("cron", time.Time{}),
+			},
+			expectedDue:     []string{"worker", "cron"},
+			expectedRequeue: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dopplerSecret := secretsv1alpha1.DopplerSecret{Spec: secretsv1alpha1.DopplerSecretSpec{Reload: test.reload}}
+			result := WorkloadReloadResult{}
+			for _, restart := range test.pending {
+				result.Workloads = append(result.Workloads, secretsv1alpha1.WorkloadStatus{Kind: "Deployment", Name: restart.workload.Object.GetName()})
+			}
+			due := r.deferPendingRestarts(dopplerSecret, test.secret, test.pending, &result)
+			dueNames := []string{}
+			for _, restart := range due {
+				dueNames = append(dueNames, restart.workload.Object.GetName())
+			}
+			if !reflect.DeepEqual(dueNames, test.expectedDue) {
+				t.Errorf("expected due restarts %v, got %v", test.expectedDue, dueNames)
+			}
+			if (result.RequeueAfter > 0) != test.expectedRequeue {
+				t.Errorf("expected requeue %v, got %v", test.expectedRequeue, result.RequeueAfter)
+			}
+			numScheduled := 0
+			for _, workload := range result.Workloads {
+				if workload.NextRestartTime != nil {
+					numScheduled++
+				}
+			}
+			if numScheduled != len(test.pending)-len(due) {
+				t.Errorf("expected %v scheduled restarts, got %v", len(test.pending)-len(due), numScheduled)
+			}
+		})
+	}
+}
+
+func TestGetWorkloadReloadSource(t *testing.T) {
+	newWorkload := func(name string, workloadLabels map[string]string, annotations map[string]string) Workload {
+		return Workload{
+			Kind:   &DefaultWorkloadKinds[0],
+			Object: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: workloadLabels, Annotations: annotations}},
+		}
+	}
+	reloadSpec := secretsv1alpha1.ReloadSpec{
+		Targets: []secretsv1alpha1.ReloadTarget{
+			{Kind: "Deployment", Name: "api"},
+			{APIVersion: "apps/v1beta1", Kind: "Deployment", Name: "legacy"},
+		},
+	}
+	selector := labels.SelectorFromSet(labels.Set{"team": "payments"})
+
+	tests := []struct {
+		name     string
+		workload Workload
+		selector labels.Selector
+		expected WorkloadReloadSource
+	}{
+		{
+			name:     "not selected",
+			workload: newWorkload("worker", nil, nil),
+			selector: selector,
+			expected: "",
+		},
+		{
+			name:     "reload annotation",
+			workload: newWorkload("worker", nil, map[string]string{workloadRestartAnnotation: "true"}),
+			selector: selector,
+			expected: WorkloadReloadSourceAnnotation,
+		},
+		{
+			name:     "reload annotation disabled",
+			workload: newWorkload("worker", nil, map[string]string{workloadRestartAnnotation: "false"}),
+			expected: "",
+		},
+		{
+			name:     "matches selector",
+			workload: newWorkload("worker", map[string]string{"team": "payments"}, map[string]string{workloadRestartAnnotation: "true"}),
+			selector: selector,
+			expected: WorkloadReloadSourceSelector,
+		},
+		{
+			name:     "no selector",
+			workload: newWorkload("worker", map[string]string{"team": "payments"}, nil),
+			expected: "",
+		},
+		{
+			name:     "explicit target",
+			workload: newWorkload("api", map[string]string{"team": "payments"}, nil),
+			selector: selector,
+			expected: WorkloadReloadSourceTarget,
+		},
+		{
+			name:     "explicit target with another API version",
+			workload: newWorkload("legacy", nil, nil),
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := getWorkloadReloadSource(test.workload, reloadSpec, test.selector)
+			if source != test.expected {
+				t.Errorf("expected source %q, got %q", test.expected, source)
+			}
+		})
+	}
+}
+
+func TestGetWorkloadRestartStrategy(t *testing.T) {
+	r := &DopplerSecretReconciler{Log: logr.Discard()}
+	getKind := func(kind string) *WorkloadKind {
+		for i := range DefaultWorkloadKinds {
+			if DefaultWorkloadKinds[i].GroupVersionKind.Kind == kind {
+				return &DefaultWorkloadKinds[i]
+			}
+		}
+		t.Fatalf("workload kind %s not found", kind)
+		return nil
+	}
+	newDopplerSecret := func(strategy string) secretsv1alpha1.DopplerSecret {
+		return secretsv1alpha1.DopplerSecret{Spec: secretsv1alpha1.DopplerSecretSpec{Reload: secretsv1alpha1.ReloadSpec{Strategy: strategy}}}
+	}
+
+	tests := []struct {
+		name          string
+		workload      Workload
+		dopplerSecret secretsv1alpha1.DopplerSecret
+		expected      RestartStrategy
+	}{
+		{
+			name:          "default",
+			workload:      Workload{Kind: getKind("Deployment"), Object: &appsv1.Deployment{}},
+			dopplerSecret: newDopplerSecret(""),
+			expected:      RestartStrategyAnnotation,
+		},
+		{
+			name:          "DopplerSecret strategy",
+			workload:      Workload{Kind: getKind("Deployment"), Object: &appsv1.Deployment{}},
+			dopplerSecret: newDopplerSecret("restartedAt"),
+			expected:      RestartStrategyRestartedAt,
+		},
+		{
+			name: "workload annotation",
+			workload: Workload{Kind: getKind("Deployment"), Object: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{workloadRestartStrategyAnnotation: "evict"},
+			}}},
+			dopplerSecret: newDopplerSecret("restartedAt"),
+			expected:      RestartStrategyEvict,
+		},
+		{
+			name: "invalid workload annotation",
+			workload: Workload{Kind: getKind("Deployment"), Object: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{workloadRestartStrategyAnnotation: "recreate"},
+			}}},
+			dopplerSecret: newDopplerSecret("restartedAt"),
+			expected:      RestartStrategyRestartedAt,
+		},
+		{
+			name: "ReplicaSets are always evicted",
+			workload: Workload{Kind: getKind("ReplicaSet"), Object: &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{workloadRestartStrategyAnnotation: "annotation"},
+			}}},
+			dopplerSecret: newDopplerSecret("restartedAt"),
+			expected:      RestartStrategyEvict,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			strategy := r.getWorkloadRestartStrategy(test.workload, test.dopplerSecret)
+			if strategy != test.expected {
+				t.Errorf("expected strategy %q, got %q", test.expected, strategy)
+			}
+		})
+	}
+}
+
+// Returns a fake client builder which indexes workloads by the secrets they use, like setupIndexes
+func newTestWorkloadClientBuilder(t *testing.T) *fake.ClientBuilder {
+	t.Helper()
+	builder := fake.NewClientBuilder().WithScheme(newTestScheme(t))
+	for i := range DefaultWorkloadKinds {
+		kind := &DefaultWorkloadKinds[i]
+		builder = builder.WithIndex(kind.NewObject(), workloadSecretNamesIndexField, indexWorkloadBySecretNames(kind))
+	}
+	return builder
+}
+
+func TestReconcileWorkloadsUsingSecretReportsStatus(t *testing.T) {
+	secretVersion := "W/\"v2\""
+	updateAnnotation := getWorkloadSecretUpdateAnnotation(testSecretName)
+	podSpec := corev1.PodSpec{Containers: []corev1.Container{{Name: "app", EnvFrom: []corev1.EnvFromSource{secretEnvFrom(testSecretName)}}}}
+	dopplerSecret := &secretsv1alpha1.DopplerSecret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec: secretsv1alpha1.DopplerSecretSpec{
+			ManagedSecretRef: secretsv1alpha1.ManagedSecretReference{Name: testSecretName},
+			Reload: secretsv1alpha1.ReloadSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "worker"}},
+			},
+		},
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        testSecretName,
+		Annotations: map[string]string{kubeSecretVersionAnnotation: secretVersion},
+	}}
+	// Restarted for the current version, but its rollout has stalled
+	failed := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "api",
+			Generation:  2,
+			Annotations: map[string]string{workloadRestartAnnotation: "true", updateAnnotation: secretVersion},
+		},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{updateAnnotation: secretVersion}},
+			Spec:       podSpec,
+		}},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration: 2,
+			Conditions: []appsv1.DeploymentCondition{
+				{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: progressDeadlineExceededReason},
+			},
+		},
+	}
+	// Selected by the reload selector and still running an older version
+	outdated := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker", Labels: map[string]string{"app": "worker"}},
+		Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}},
+	}
+	// Uses the secret but isn't selected for reloads
+	ignored := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cron"},
+		Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}},
+	}
+	fakeClient := newTestWorkloadClientBuilder(t).
+		WithObjects(dopplerSecret, secret, failed, outdated, ignored).
+		WithStatusSubresource(&secretsv1alpha1.DopplerSecret{}).
+		Build()
+	r := &DopplerSecretReconciler{Client: fakeClient, Log: logr.Discard(), Rollouts: NewRolloutOrchestrator(0)}
+
+	result, err := r.ReconcileWorkloadsUsingSecret(context.Background(), *dopplerSecret)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Workloads) != 2 {
+		t.Fatalf("expected 2 workloads, got %+v", result.Workloads)
+	}
+	api, worker := result.Workloads[0], result.Workloads[1]
+	if api.Name != "api" || api.Source != string(WorkloadReloadSourceAnnotation) || api.SecretVersion != secretVersion || api.RolloutState != string(RolloutStateFailed) {
+		t.Errorf("unexpected status for the failed workload: %+v", api)
+	}
+	if worker.Name != "worker" || worker.Source != string(WorkloadReloadSourceSelector) || worker.SecretVersion != secretVersion ||
+		worker.RolloutState != string(RolloutStateProgressing) || worker.LastRestartTime == nil {
+		t.Errorf("unexpected status for the restarted workload: %+v", worker)
+	}
+	if !reflect.DeepEqual(result.FailedWorkloads, []string{"Deployment default/api"}) {
+		t.Errorf("expected the stalled rollout to be reported as failed, got %v", result.FailedWorkloads)
+	}
+	if result.NumPending != 0 || result.RequeueAfter != rolloutProgressCheckInterval {
+		t.Errorf("expected to check back on the restarted workload, got %d pending and requeue after %s", result.NumPending, result.RequeueAfter)
+	}
+
+	restarted := &appsv1.Deployment{}
+	if err := fakeClient.Get(context.Background(), client.ObjectKeyFromObject(outdated), restarted); err != nil {
+		t.Fatalf("unable to fetch restarted workload: %v", err)
+	}
+	if restarted.Spec.Template.Annotations[updateAnnotation] != secretVersion {
+		t.Errorf("expected the restarted workload's pod template to be annotated with %s, got %v", secretVersion, restarted.Spec.Template.Annotations)
+	}
+
+	r.SetDeploymentReloadReadyCondition(context.Background(), dopplerSecret, result, nil)
+	updated := &secretsv1alpha1.DopplerSecret{}
+	if err := fakeClient.Get(context.Background(), client.ObjectKeyFromObject(dopplerSecret), updated); err != nil {
+		t.Fatalf("unable to fetch DopplerSecret: %v", err)
+	}
+	if len(updated.Status.Workloads) != 2 {
+		t.Errorf("expected the workloads to be reported in the status, got %+v", updated.Status.Workloads)
+	}
+	condition := meta.FindStatusCondition(updated.Status.Conditions, "secrets.doppler.com/WorkloadRolloutHealthy")
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "RolloutFailed" {
+		t.Errorf("expected an unhealthy rollout condition, got %+v", condition)
+	}
+}
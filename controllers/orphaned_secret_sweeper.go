@@ -0,0 +1,194 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
+)
+
+const (
+	kubeSecretSubtypeLabel            = "secrets.doppler.com/subtype"
+	kubeSecretOrphanedSinceAnnotation = "secrets.doppler.com/orphaned-since"
+)
+
+var orphanedSecretsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "doppler_operator_orphaned_secrets",
+	Help: "Number of secrets created by the operator whose DopplerSecret no longer exists",
+})
+
+func init() {
+	metrics.Registry.MustRegister(orphanedSecretsGauge)
+}
+
+// OrphanedSecretSweeper periodically finds secrets created by the operator whose DopplerSecret no longer exists.
+// Orphaned secrets are reported with a metric and events and, if enabled, deleted once they've been orphaned for the grace period.
+// Secrets deliberately kept by the Retain or Orphan deletion policies are ignored.
+type OrphanedSecretSweeper struct {
+	Client   client.Client
+	Log      logr.Logger
+	Recorder record.EventRecorder
+
+	// How often to look for orphaned secrets
+	Interval time.Duration
+
+	// How long a secret must be orphaned before it's deleted
+	GracePeriod time.Duration
+
+	// Whether to delete orphaned secrets after the grace period, otherwise they're only reported
+	DeleteOrphans bool
+}
+
+// Start runs the sweeper until the context is cancelled. Implements manager.Runnable.
+func (s *OrphanedSecretSweeper) Start(ctx context.Context) error {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sweep(ctx); err != nil {
+			s.Log.Error(err, "Unable to sweep orphaned secrets")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection ensures only one replica of the operator sweeps orphaned secrets. Implements manager.LeaderElectionRunnable.
+func (s *OrphanedSecretSweeper) NeedLeaderElection() bool {
+	return true
+}
+
+// Sweep finds, reports and (if enabled) deletes orphaned secrets
+func (s *OrphanedSecretSweeper) Sweep(ctx context.Context) error {
+	subtypeRequirement, err := labels.NewRequirement(kubeSecretSubtypeLabel, selection.In, []string{"dopplerSecret", previousSecretSubtype})
+	if err != nil {
+		return err
+	}
+	orphanedRequirement, err := labels.NewRequirement(kubeSecretOrphanedLabel, selection.DoesNotExist, nil)
+	if err != nil {
+		return err
+	}
+	// Secrets whose DopplerSecret has the Retain deletion policy are kept once it's deleted. There's no finalizer to label them at that point
+	// so the policy is recorded on the secret when it's synced.
+	retainedRequirement, err := labels.NewRequirement(kubeSecretDeletionPolicyLabel, selection.NotIn, []string{string(DeletionPolicyRetain)})
+	if err != nil {
+		return err
+	}
+	secrets := &corev1.SecretList{}
+	err = s.Client.List(ctx, secrets, client.MatchingLabelsSelector{Selector: labels.NewSelector().Add(*subtypeRequirement, *orphanedRequirement, *retainedRequirement)})
+	if err != nil {
+		return fmt.Errorf("Unable to list managed secrets: %w", err)
+	}
+
+	numOrphaned := 0
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		orphaned, err := s.isOrphaned(ctx, secret)
+		if err != nil {
+			s.Log.Error(err, "Unable to check if secret is orphaned", "secret", client.ObjectKeyFromObject(secret).String())
+			continue
+		}
+		if err := s.reconcileSecret(ctx, secret, orphaned); err != nil {
+			s.Log.Error(err, "Unable to reconcile orphaned secret", "secret", client.ObjectKeyFromObject(secret).String())
+		}
+		if orphaned {
+			numOrphaned++
+		}
+	}
+	orphanedSecretsGauge.Set(float64(numOrphaned))
+	s.Log.Info("Finished sweeping orphaned secrets", "numSecrets", len(secrets.Items), "numOrphaned", numOrphaned)
+	return nil
+}
+
+// A secret is orphaned if the DopplerSecret in its managed-by annotation doesn't exist
+func (s *OrphanedSecretSweeper) isOrphaned(ctx context.Context, secret *corev1.Secret) (bool, error) {
+	managedBy, ok := secret.Annotations[kubeSecretManagedByAnnotation]
+	if !ok {
+		// Secrets created by older versions of the operator don't record their DopplerSecret
+		return false, nil
+	}
+	namespace, name, found := strings.Cut(managedBy, "/")
+	if !found {
+		return false, fmt.Errorf("Invalid managed-by annotation %q", managedBy)
+	}
+	err := s.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &secretsv1alpha1.DopplerSecret{})
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *OrphanedSecretSweeper) reconcileSecret(ctx context.Context, secret *corev1.Secret, orphaned bool) error {
+	log := s.Log.WithValues("secret", client.ObjectKeyFromObject(secret).String(), "managedBy", secret.Annotations[kubeSecretManagedByAnnotation])
+	orphanedSinceValue, hasOrphanedSince := secret.Annotations[kubeSecretOrphanedSinceAnnotation]
+	if !orphaned {
+		if !hasOrphanedSince {
+			return nil
+		}
+		// The DopplerSecret was recreated
+		delete(secret.Annotations, kubeSecretOrphanedSinceAnnotation)
+		return s.Client.Update(ctx, secret)
+	}
+
+	if !hasOrphanedSince {
+		log.Info("[-] Found orphaned secret")
+		s.recordEvent(secret, corev1.EventTypeWarning, eventReasonOrphanedSecret, "Secret is managed by DopplerSecret %s which no longer exists", secret.Annotations[kubeSecretManagedByAnnotation])
+		secret.Annotations[kubeSecretOrphanedSinceAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		return s.Client.Update(ctx, secret)
+	}
+
+	orphanedSince, err := time.Parse(time.RFC3339, orphanedSinceValue)
+	if err != nil {
+		return fmt.Errorf("Invalid orphaned-since annotation %q: %w", orphanedSinceValue, err)
+	}
+	if !s.DeleteOrphans || time.Since(orphanedSince) < s.GracePeriod {
+		return nil
+	}
+	if err := s.Client.Delete(ctx, secret, client.Preconditions{ResourceVersion: &secret.ResourceVersion}); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("Unable to delete orphaned secret: %w", err)
+	}
+	log.Info("[/] Deleted orphaned secret", "orphanedSince", orphanedSinceValue)
+	s.recordEvent(secret, corev1.EventTypeNormal, eventReasonOrphanedSecretDeleted, "Deleted secret orphaned since %s", orphanedSinceValue)
+	return nil
+}
+
+func (s *OrphanedSecretSweeper) recordEvent(object *corev1.Secret, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if s.Recorder == nil {
+		return
+	}
+	s.Recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func withTestSecretLabel(secret *corev1.Secret, key string, value string) *corev1.Secret {
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[key] = value
+	return secret
+}
+
+func withTestOrphanedSince(secret *corev1.Secret, orphanedSince time.Time) *corev1.Secret {
+	secret.Annotations[kubeSecretOrphanedSinceAnnotation] = orphanedSince.UTC().Format(time.RFC3339)
+	return secret
+}
+
+func newTestSweeper(t *testing.T, deleteOrphans bool, objects ...client.Object) (*OrphanedSecretSweeper, *record.FakeRecorder) {
+	t.Helper()
+	recorder := record.NewFakeRecorder(10)
+	return &OrphanedSecretSweeper{
+		Client:        fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(objects...).Build(),
+		Log:           logr.Discard(),
+		Recorder:      recorder,
+		GracePeriod:   time.Hour,
+		DeleteOrphans: deleteOrphans,
+	}, recorder
+}
+
+func TestSweepMarksOrphanedSecrets(t *testing.T) {
+	sweeper, recorder := newTestSweeper(t, true,
+		newTestDopplerSecret("default", "app", "", "app-secret"),
+		// Managed by a DopplerSecret which exists
+		newTestOperatorSecret("app-secret", "default/app", "dopplerSecret"),
+		// Managed by DopplerSecrets which no longer exist
+		withTestSecretLabel(newTestOperatorSecret("deleted-secret", "default/deleted", "dopplerSecret"), kubeSecretDeletionPolicyLabel, string(DeletionPolicyDelete)),
+		newTestOperatorSecret("legacy-policy-secret", "default/deleted", "dopplerSecret"),
+		newTestOperatorSecret(GetPreviousSecretName("retained-secret"), "default/retained", previousSecretSubtype),
+		// Kept by the DopplerSecret's deletion policy
+		withTestSecretLabel(newTestOperatorSecret("retained-secret", "default/retained", "dopplerSecret"), kubeSecretDeletionPolicyLabel, string(DeletionPolicyRetain)),
+		withTestSecretLabel(newTestOperatorSecret("orphaned-secret", "default/orphaned", "dopplerSecret"), kubeSecretOrphanedLabel, "true"),
+		// Created by older versions of the operator which didn't record the DopplerSecret
+		withTestSecretLabel(newTestOperatorSecret("unannotated-secret", "", ""), kubeSecretSubtypeLabel, "dopplerSecret"),
+	)
+
+	if err := sweeper.Sweep(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	marked := []string{}
+	for _, name := range []string{"app-secret", "deleted-secret", "legacy-policy-secret", GetPreviousSecretName("retained-secret"), "retained-secret", "orphaned-secret", "unannotated-secret"} {
+		secret := getTestSecretIfExists(t, sweeper.Client, name)
+		if secret == nil {
+			t.Fatalf("expected secret %s not to be deleted before the grace period", name)
+		}
+		if _, ok := secret.Annotations[kubeSecretOrphanedSinceAnnotation]; ok {
+			marked = append(marked, name)
+		}
+	}
+	expected := []string{"deleted-secret", "legacy-policy-secret", GetPreviousSecretName("retained-secret")}
+	if !reflect.DeepEqual(marked, expected) {
+		t.Errorf("expected %v to be marked as orphaned, got %v", expected, marked)
+	}
+	if numOrphaned := testutil.ToFloat64(orphanedSecretsGauge); numOrphaned != 3 {
+		t.Errorf("expected 3 orphaned secrets to be reported, got %v", numOrphaned)
+	}
+	if reasons := getRecordedEventReasons(recorder); !reflect.DeepEqual(reasons, []string{eventReasonOrphanedSecret, eventReasonOrphanedSecret, eventReasonOrphanedSecret}) {
+		t.Errorf("expected an event for each orphaned secret, got %v", reasons)
+	}
+
+	// Marked secrets keep the time they were first found
+	orphanedSince := getTestSecretIfExists(t, sweeper.Client, "deleted-secret").Annotations[kubeSecretOrphanedSinceAnnotation]
+	if err := sweeper.Sweep(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value := getTestSecretIfExists(t, sweeper.Client, "deleted-secret").Annotations[kubeSecretOrphanedSinceAnnotation]; value != orphanedSince {
+		t.Errorf("expected orphaned-since to stay %s, got %s", orphanedSince, value)
+	}
+	if reasons := getRecordedEventReasons(recorder); len(reasons) != 0 {
+		t.Errorf("expected no events for secrets which were already marked, got %v", reasons)
+	}
+}
+
+func TestSweepDeletesOrphanedSecretsAfterGracePeriod(t *testing.T) {
+	tests := []struct {
+		name          string
+		deleteOrphans bool
+		orphanedFor   time.Duration
+		deleted       bool
+	}{
+		{name: "within the grace period", deleteOrphans: true, orphanedFor: time.Minute, deleted: false},
+		{name: "after the grace period", deleteOrphans: true, orphanedFor: 2 * time.Hour, deleted: true},
+		{name: "after the grace period with deletion disabled", deleteOrphans: false, orphanedFor: 2 * time.Hour, deleted: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orphanedSince := time.Now().Add(-test.orphanedFor)
+			sweeper, recorder := newTestSweeper(t, test.deleteOrphans,
+				withTestOrphanedSince(newTestOperatorSecret("deleted-secret", "default/deleted", "dopplerSecret"), orphanedSince),
+				withTestOrphanedSince(withTestSecretLabel(newTestOperatorSecret("retained-secret", "default/retained", "dopplerSecret"), kubeSecretDeletionPolicyLabel, string(DeletionPolicyRetain)), orphanedSince),
+			)
+
+			if err := sweeper.Sweep(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if deleted := getTestSecretIfExists(t, sweeper.Client, "deleted-secret") == nil; deleted != test.deleted {
+				t.Errorf("expected orphaned secret deleted to be %t", test.deleted)
+			}
+			if getTestSecretIfExists(t, sweeper.Client, "retained-secret") == nil {
+				t.Errorf("expected the retained secret never to be deleted")
+			}
+			expectedEvents := []string{}
+			if test.deleted {
+				expectedEvents = append(expectedEvents, eventReasonOrphanedSecretDeleted)
+			}
+			if reasons := getRecordedEventReasons(recorder); !reflect.DeepEqual(reasons, expectedEvents) {
+				t.Errorf("expected events %v, got %v", expectedEvents, reasons)
+			}
+		})
+	}
+}
+
+func TestSweepUnmarksSecretsWhoseDopplerSecretIsRecreated(t *testing.T) {
+	sweeper, _ := newTestSweeper(t, true,
+		newTestDopplerSecret("default", "app", "", "app-secret"),
+		withTestOrphanedSince(newTestOperatorSecret("app-secret", "default/app", "dopplerSecret"), time.Now().Add(-2*time.Hour)),
+	)
+
+	if err := sweeper.Sweep(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret := getTestSecretIfExists(t, sweeper.Client, "app-secret")
+	if secret == nil {
+		t.Fatalf("expected the secret of an existing DopplerSecret not to be deleted")
+	}
+	if _, ok := secret.Annotations[kubeSecretOrphanedSinceAnnotation]; ok {
+		t.Errorf("expected the orphaned-since annotation to be removed, got %v", secret.Annotations)
+	}
+}
@@ -19,21 +19,26 @@ package main
 import (
 	"flag"
 	"os"
+	"slices"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
 	secretsv1alpha1 "github.com/DopplerHQ/kubernetes-operator/api/v1alpha1"
 	"github.com/DopplerHQ/kubernetes-operator/controllers"
+	"github.com/DopplerHQ/kubernetes-operator/pkg/api"
 	"github.com/DopplerHQ/kubernetes-operator/pkg/version"
 	//+kubebuilder:scaffold:imports
 )
@@ -55,12 +60,39 @@ func main() {
 	var enableLeaderElection bool
 	var probeAddr string
 	var oidcProviderCacheSize int
+	var extraWorkloadKinds string
+	var maxConcurrentRestarts int
+	var orphanSweepInterval time.Duration
+	var orphanGracePeriod time.Duration
+	var deleteOrphanedSecrets bool
+	var failureBackoffBase time.Duration
+	var failureBackoffMax time.Duration
+	var failureBackoffMaxNonRetryable time.Duration
+	var resyncJitter float64
+	var startupStagger time.Duration
+	var dopplerAPIQPS float64
+	var dopplerAPIBurst int
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.IntVar(&oidcProviderCacheSize, "oidc-provider-cache-size", 2<<13, "Size of the OIDC provider cache. Set to 0 to disable caching.")
+	flag.StringVar(&extraWorkloadKinds, "extra-workload-kinds", "",
+		"Comma-separated list of additional workload kinds to reload, in the format <group>/<version>/<kind>=<pod template path>. "+
+			"For example: argoproj.io/v1alpha1/Rollout=spec.template")
+	flag.IntVar(&maxConcurrentRestarts, "max-concurrent-restarts", 0, "The maximum number of workloads rolling out at once across all DopplerSecrets. Set to 0 for no limit.")
+	flag.DurationVar(&orphanSweepInterval, "orphan-sweep-interval", 10*time.Minute, "How often to look for managed secrets whose DopplerSecret no longer exists. Set to 0 to disable.")
+	flag.DurationVar(&orphanGracePeriod, "orphan-grace-period", 24*time.Hour, "How long a managed secret must be orphaned before it's deleted, if --delete-orphaned-secrets is set.")
+	flag.BoolVar(&deleteOrphanedSecrets, "delete-orphaned-secrets", false, "Delete managed secrets whose DopplerSecret no longer exists once they've been orphaned for the grace period.")
+	flag.DurationVar(&failureBackoffBase, "failure-backoff-base", controllers.DefaultFailureBackoff.Base, "How long to wait before retrying a DopplerSecret after its first failed sync. Doubles with each consecutive failure.")
+	flag.DurationVar(&failureBackoffMax, "failure-backoff-max", controllers.DefaultFailureBackoff.Max, "The maximum delay before retrying a failed DopplerSecret.")
+	flag.DurationVar(&failureBackoffMaxNonRetryable, "failure-backoff-max-non-retryable", controllers.DefaultFailureBackoff.MaxNonRetryable,
+		"The maximum delay before retrying a DopplerSecret whose token was rejected by Doppler (401 or 403).")
+	flag.Float64Var(&resyncJitter, "resync-jitter", 0.1, "The maximum fraction of the resync interval added to each DopplerSecret's interval, so resyncs are spread out.")
+	flag.DurationVar(&startupStagger, "startup-stagger", 30*time.Second, "The window over which the initial syncs of existing DopplerSecrets are spread after the operator starts. Set to 0 to sync them all at once.")
+	flag.Float64Var(&dopplerAPIQPS, "doppler-api-qps", 0, "The maximum number of requests per second to the Doppler API across all DopplerSecrets. Set to 0 for no limit.")
+	flag.IntVar(&dopplerAPIBurst, "doppler-api-burst", 10, "The maximum burst of requests to the Doppler API when --doppler-api-qps is set.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -72,6 +104,16 @@ func main() {
 
 	controllers.InitializeOIDCCache(log, oidcProviderCacheSize)
 
+	extraKinds, err := controllers.ParseWorkloadKinds(extraWorkloadKinds)
+	if err != nil {
+		setupLog.Error(err, "unable to parse extra workload kinds")
+		os.Exit(1)
+	}
+	workloadKinds := slices.Concat(controllers.DefaultWorkloadKinds, extraKinds)
+	for _, kind := range extraKinds {
+		setupLog.Info("registered extra workload kind", "kind", kind.GroupVersionKind.String())
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
 		Metrics: metricsserver.Options{
@@ -80,20 +122,52 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "f39fa519.doppler.com",
+		Client: client.Options{
+			Cache: &client.CacheOptions{
+				// Pods are only listed when evicting them, so avoid caching every pod in the cluster
+				DisableFor: []client.Object{&corev1.Pod{}},
+				// Custom workload kinds are read as unstructured objects and must be cached to be looked up by index
+				Unstructured: true,
+			},
+		},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	api.SetRateLimit(float32(dopplerAPIQPS), dopplerAPIBurst)
+
 	if err = (&controllers.DopplerSecretReconciler{
-		Client: mgr.GetClient(),
-		Log:    log,
-		Scheme: mgr.GetScheme(),
+		Client:        mgr.GetClient(),
+		Log:           log,
+		Scheme:        mgr.GetScheme(),
+		WorkloadKinds: workloadKinds,
+		Rollouts:      controllers.NewRolloutOrchestrator(maxConcurrentRestarts),
+		Recorder:      mgr.GetEventRecorderFor("dopplersecret-controller"),
+		Backoff: &controllers.FailureBackoff{
+			Base:            failureBackoffBase,
+			Max:             failureBackoffMax,
+			MaxNonRetryable: failureBackoffMaxNonRetryable,
+		},
+		Schedule: controllers.NewResyncSchedule(resyncJitter, startupStagger),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DopplerSecret")
 		os.Exit(1)
 	}
+	if orphanSweepInterval > 0 {
+		if err := mgr.Add(&controllers.OrphanedSecretSweeper{
+			Client:        mgr.GetClient(),
+			Log:           ctrl.Log.WithName("controllers").WithName("OrphanedSecretSweeper"),
+			Recorder:      mgr.GetEventRecorderFor("orphaned-secret-sweeper"),
+			Interval:      orphanSweepInterval,
+			GracePeriod:   orphanGracePeriod,
+			DeleteOrphans: deleteOrphanedSecrets,
+		}); err != nil {
+			setupLog.Error(err, "unable to add orphaned secret sweeper")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
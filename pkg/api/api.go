@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"strings"
 	"time"
 
+	"k8s.io/client-go/util/flowcontrol"
+
 	"github.com/DopplerHQ/kubernetes-operator/pkg/models"
 
 	"github.com/DopplerHQ/kubernetes-operator/pkg/version"
@@ -28,9 +31,28 @@ type APIResponse struct {
 	Body         []byte
 }
 
+// ErrorClass classifies an APIError so callers can tell failures which need intervention (e.g. a revoked token)
+// apart from those which resolve themselves (e.g. Doppler being unavailable)
+type ErrorClass string
+
+const (
+	ErrorClassUnauthorized ErrorClass = "Unauthorized"
+	ErrorClassForbidden    ErrorClass = "Forbidden"
+	ErrorClassNotFound     ErrorClass = "NotFound"
+	ErrorClassRateLimited  ErrorClass = "RateLimited"
+	ErrorClassServerError  ErrorClass = "ServerError"
+	ErrorClassNetwork      ErrorClass = "Network"
+	ErrorClassParseError   ErrorClass = "ParseError"
+	// Any other failure, e.g. an invalid request
+	ErrorClassUnknown ErrorClass = "Unknown"
+)
+
 type APIError struct {
 	Err     error
 	Message string
+	// The HTTP status code of the response, or 0 if no response was received
+	StatusCode int
+	Class      ErrorClass
 }
 
 type ErrorResponse struct {
@@ -51,13 +73,55 @@ func (e *APIError) Error() string {
 	return message
 }
 
+// ClassifyStatusCode returns the error class for an unsuccessful HTTP status code
+func ClassifyStatusCode(statusCode int) ErrorClass {
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return ErrorClassUnauthorized
+	case statusCode == http.StatusForbidden:
+		return ErrorClassForbidden
+	case statusCode == http.StatusNotFound:
+		return ErrorClassNotFound
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorClassRateLimited
+	case statusCode >= 500:
+		return ErrorClassServerError
+	default:
+		return ErrorClassUnknown
+	}
+}
+
+// Limits requests to the Doppler API across all DopplerSecrets, unlimited if nil
+var rateLimiter flowcontrol.RateLimiter
+
+// SetRateLimit limits requests to the Doppler API to qps requests per second, with bursts of up to burst requests.
+// Requests are unlimited if qps isn't positive. Must be called before any requests are made.
+func SetRateLimit(qps float32, burst int) {
+	if qps <= 0 {
+		rateLimiter = nil
+		return
+	}
+	rateLimiter = flowcontrol.NewTokenBucketRateLimiter(qps, max(burst, 1))
+}
+
+// WaitForRateLimit blocks until a request to the Doppler API is allowed by the rate limit
+func WaitForRateLimit(ctx context.Context) error {
+	if rateLimiter == nil {
+		return nil
+	}
+	return rateLimiter.Wait(ctx)
+}
+
 func isSuccess(statusCode int) bool {
 	return (statusCode >= 200 && statusCode <= 299) || (statusCode >= 300 && statusCode <= 399)
 }
 
-func GetRequest(context APIContext, path string, headers map[string]string, params []QueryParam) (*APIResponse, *APIError) {
-	url := fmt.Sprintf("%s%s", context.Host, path)
-	req, err := http.NewRequest("GET", url, nil)
+func GetRequest(ctx context.Context, apiContext APIContext, path string, headers map[string]string, params []QueryParam) (*APIResponse, *APIError) {
+	url := fmt.Sprintf("%s%s", apiContext.Host, path)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, &APIError{Err: err, Message: "Unable to form request", Class: ErrorClassUnknown}
+	}
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
@@ -66,11 +130,8 @@ func GetRequest(context APIContext, path string, headers map[string]string, para
 		query.Add(param.Key, param.Value)
 	}
 	req.URL.RawQuery = query.Encode()
-	if err != nil {
-		return nil, &APIError{Err: err, Message: "Unable to form request"}
-	}
 
-	return PerformRequest(context, req)
+	return PerformRequest(apiContext, req)
 }
 
 func PerformRequest(context APIContext, req *http.Request) (*APIResponse, *APIError) {
@@ -96,15 +157,20 @@ func PerformRequest(context APIContext, req *http.Request) (*APIResponse, *APIEr
 		TLSClientConfig:   tlsConfig,
 	}
 
+	// The wait ends early if the request's context is done. That's a local failure rather than Doppler rate limiting the request.
+	if err := WaitForRateLimit(req.Context()); err != nil {
+		return nil, &APIError{Err: err, Message: "Unable to wait for rate limit", Class: ErrorClassUnknown}
+	}
+
 	r, err := client.Do(req)
 	if err != nil {
-		return nil, &APIError{Err: err, Message: "Unable to load response"}
+		return nil, &APIError{Err: err, Message: "Unable to load response", Class: ErrorClassNetwork}
 	}
 	defer r.Body.Close()
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return &APIResponse{HTTPResponse: r, Body: nil}, &APIError{Err: err, Message: "Unable to load response data"}
+		return &APIResponse{HTTPResponse: r, Body: nil}, &APIError{Err: err, Message: "Unable to load response data", StatusCode: r.StatusCode, Class: ErrorClassNetwork}
 	}
 	response := &APIResponse{HTTPResponse: r, Body: body}
 
@@ -113,19 +179,19 @@ func PerformRequest(context APIContext, req *http.Request) (*APIResponse, *APIEr
 			var errResponse ErrorResponse
 			err := json.Unmarshal(body, &errResponse)
 			if err != nil {
-				return response, &APIError{Err: err, Message: "Unable to load response"}
+				return response, &APIError{Err: err, Message: "Unable to load response", StatusCode: r.StatusCode, Class: ClassifyStatusCode(r.StatusCode)}
 			}
-			return response, &APIError{Err: nil, Message: strings.Join(errResponse.Messages, "\n")}
+			return response, &APIError{Err: nil, Message: strings.Join(errResponse.Messages, "\n"), StatusCode: r.StatusCode, Class: ClassifyStatusCode(r.StatusCode)}
 		}
-		return nil, &APIError{Err: fmt.Errorf("%d status code; %d bytes", r.StatusCode, len(body)), Message: "Unable to load response"}
+		return nil, &APIError{Err: fmt.Errorf("%d status code; %d bytes", r.StatusCode, len(body)), Message: "Unable to load response", StatusCode: r.StatusCode, Class: ClassifyStatusCode(r.StatusCode)}
 	}
 	if err != nil {
-		return nil, &APIError{Err: err, Message: "Unable to parse response data"}
+		return nil, &APIError{Err: err, Message: "Unable to parse response data", Class: ErrorClassParseError}
 	}
 	return response, nil
 }
 
-func GetSecrets(context APIContext, lastETag string, project string, config string, nameTransformer string, format string, secrets []string) (*models.SecretsResult, *APIError) {
+func GetSecrets(ctx context.Context, apiContext APIContext, lastETag string, project string, config string, nameTransformer string, format string, secrets []string) (*models.SecretsResult, *APIError) {
 	headers := map[string]string{}
 	if lastETag != "" {
 		headers["If-None-Match"] = lastETag
@@ -148,7 +214,7 @@ func GetSecrets(context APIContext, lastETag string, project string, config stri
 		params = append(params, QueryParam{Key: "format", Value: format})
 	}
 
-	response, err := GetRequest(context, "/v3/configs/config/secrets/download", headers, params)
+	response, err := GetRequest(ctx, apiContext, "/v3/configs/config/secrets/download", headers, params)
 	if err != nil {
 		return nil, err
 	}
@@ -169,7 +235,7 @@ func GetSecrets(context APIContext, lastETag string, project string, config stri
 
 	result, modelErr := parseSecrets(response.Body, eTag)
 	if modelErr != nil {
-		return nil, &APIError{Err: modelErr, Message: "Unable to parse secrets"}
+		return nil, &APIError{Err: modelErr, Message: "Unable to parse secrets", Class: ErrorClassParseError}
 	}
 	return result, nil
 }
@@ -0,0 +1,76 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClassifyStatusCode(t *testing.T) {
+	tests := map[int]ErrorClass{
+		400: ErrorClassUnknown,
+		401: ErrorClassUnauthorized,
+		403: ErrorClassForbidden,
+		404: ErrorClassNotFound,
+		429: ErrorClassRateLimited,
+		500: ErrorClassServerError,
+		503: ErrorClassServerError,
+	}
+	for statusCode, expected := range tests {
+		if class := ClassifyStatusCode(statusCode); class != expected {
+			t.Errorf("expected class %s for status %d, got %s", expected, statusCode, class)
+		}
+	}
+}
+
+func TestGetSecretsStopsWaitingForRateLimitWhenCanceled(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	t.Cleanup(server.Close)
+	SetRateLimit(0.001, 1)
+	t.Cleanup(func() { SetRateLimit(0, 0) })
+	apiContext := APIContext{Host: server.URL, APIKey: "dp.st.test"}
+
+	// Uses up the burst
+	if _, err := GetSecrets(context.Background(), apiContext, "v1", "", "", "", "", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := GetSecrets(ctx, apiContext, "v1", "", "", "", "", nil)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if err.Class == ErrorClassRateLimited {
+		t.Errorf("expected a canceled wait not to be reported as rate limited by Doppler")
+	}
+	if !errors.Is(err.Err, context.Canceled) {
+		t.Errorf("expected the context error, got %v", err.Err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected the canceled request not to be sent, got %d requests", requests.Load())
+	}
+}
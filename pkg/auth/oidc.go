@@ -14,6 +14,8 @@ import (
 	authenticationv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+
+	"github.com/DopplerHQ/kubernetes-operator/pkg/api"
 )
 
 // Handle OIDC-based authentication
@@ -137,19 +139,29 @@ func (o *OIDCAuthProvider) exchangeTokenWithDoppler(ctx context.Context, saToken
 		Transport: transport,
 	}
 
+	// The token exchange shares the Doppler API rate limit with secrets requests
+	if err := api.WaitForRateLimit(ctx); err != nil {
+		return "", time.Time{}, &api.APIError{Err: err, Message: "Unable to wait for rate limit", Class: api.ErrorClassUnknown}
+	}
+
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("Failed to make request to Doppler: %w", err)
+		return "", time.Time{}, &api.APIError{Err: err, Message: "Failed to make request to Doppler", Class: api.ErrorClassNetwork}
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("Failed to read response body: %w", err)
+		return "", time.Time{}, &api.APIError{Err: err, Message: "Failed to read response body", StatusCode: resp.StatusCode, Class: api.ErrorClassNetwork}
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return "", time.Time{}, fmt.Errorf("Doppler OIDC auth failed with status %d: %s", resp.StatusCode, string(body))
+		return "", time.Time{}, &api.APIError{
+			Err:        fmt.Errorf("%d status code: %s", resp.StatusCode, string(body)),
+			Message:    "OIDC auth failed",
+			StatusCode: resp.StatusCode,
+			Class:      api.ClassifyStatusCode(resp.StatusCode),
+		}
 	}
 
 	var response struct {
@@ -159,7 +171,7 @@ func (o *OIDCAuthProvider) exchangeTokenWithDoppler(ctx context.Context, saToken
 	}
 
 	if err := json.Unmarshal(body, &response); err != nil {
-		return "", time.Time{}, fmt.Errorf("Failed to parse response: %w", err)
+		return "", time.Time{}, &api.APIError{Err: err, Message: "Failed to parse response", StatusCode: resp.StatusCode, Class: api.ErrorClassParseError}
 	}
 
 	if !response.Success {